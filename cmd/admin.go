@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"log"
+	"net"
+
+	"github.com/spf13/viper"
+
+	"github.com/lectio/imap-facade-openproject/facade"
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+// adminRequest sends the admin command to the running facade.  If the facade
+// isn't running the command is handled with the cache db.
+func adminRequest(req *backend.AdminRequest, readOnly bool) *backend.AdminResponse {
+	if cfgAdmin := viper.Sub("admin"); cfgAdmin != nil && cfgAdmin.GetBool("enabled") {
+		res, err := facade.SendAdminRequest(cfgAdmin.GetString("socket"), req)
+		if err == nil {
+			return res
+		}
+		if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "dial" {
+			log.Fatal(err)
+		}
+	}
+
+	cfgOP := viper.Sub("openprojects")
+	if cfgOP == nil {
+		log.Fatal("Missing 'openprojects'")
+	}
+	var cache *backend.Cache
+	var err error
+	if readOnly {
+		cache, err = backend.OpenReadOnlyCache(cfgOP.Sub("cache"))
+	} else {
+		cache, err = backend.OpenCache(cfgOP.Sub("cache"))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cache.Close()
+
+	res, err := cache.HandleAdmin(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return res
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+// appPasswordCmd represents the app-password command
+var appPasswordCmd = &cobra.Command{
+	Use:   "app-password",
+	Short: "Manage app passwords",
+	Long: `Create, list and revoke per-device app passwords.
+
+App passwords are used instead of the OpenProject API key to login.
+Commands are sent to the running facade if '[admin]' is enabled.`,
+}
+
+var appPasswordCreateCmd = &cobra.Command{
+	Use:   "create [username] [device]",
+	Short: "Create an app password for a device",
+	Long: `Create an app password for a device.
+
+The user's OpenProject API key is read from stdin.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		res := adminRequest(&backend.AdminRequest{
+			Command: backend.AdminCreateAppPassword,
+			User:    args[0],
+			Device:  args[1],
+			APIKey:  readAPIKey(),
+		}, false)
+		ap := res.AppPasswords[0]
+		fmt.Printf("App password %d for %s (%s): %s\n", ap.Id, ap.User, ap.Device, res.Password)
+	},
+}
+
+var appPasswordListCmd = &cobra.Command{
+	Use:   "list [username]",
+	Short: "List app passwords",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := ""
+		if len(args) > 0 {
+			username = args[0]
+		}
+		res := adminRequest(&backend.AdminRequest{
+			Command: backend.AdminListAppPasswords,
+			User:    username,
+		}, true)
+		for _, ap := range res.AppPasswords {
+			lastUsed := "never"
+			if !ap.LastUsed.IsZero() {
+				lastUsed = ap.LastUsed.Format(time.RFC3339)
+			}
+			revoked := ""
+			if !ap.Revoked.IsZero() {
+				revoked = " revoked=" + ap.Revoked.Format(time.RFC3339)
+			}
+			fmt.Printf("%d %s %q created=%s last-used=%s%s\n",
+				ap.Id, ap.User, ap.Device, ap.Created.Format(time.RFC3339), lastUsed, revoked)
+		}
+	},
+}
+
+var appPasswordRevokeCmd = &cobra.Command{
+	Use:   "revoke [id]",
+	Short: "Revoke an app password",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			log.Fatalf("Invalid app password id '%s'", args[0])
+		}
+
+		res := adminRequest(&backend.AdminRequest{
+			Command:       backend.AdminRevokeAppPassword,
+			AppPasswordID: id,
+		}, false)
+		ap := res.AppPasswords[0]
+		fmt.Printf("Revoked app password %d for %s (%s)\n", ap.Id, ap.User, ap.Device)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(appPasswordCmd)
+
+	appPasswordCmd.AddCommand(appPasswordCreateCmd)
+	appPasswordCmd.AddCommand(appPasswordListCmd)
+	appPasswordCmd.AddCommand(appPasswordRevokeCmd)
+}
+
+// readAPIKey reads the API key from stdin, so it doesn't show up in the
+// process list or shell history.
+func readAPIKey() string {
+	fmt.Fprint(os.Stderr, "OpenProject API key: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Fatal("Failed to read API key:", err)
+	}
+	apiKey := strings.TrimSpace(line)
+	if apiKey == "" {
+		log.Fatal("Missing API key")
+	}
+	return apiKey
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+var (
+	auditUser        string
+	auditWorkPackage int
+	auditSince       string
+	auditUntil       string
+)
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Query the audit log",
+	Long: `Show the changes made to OpenProject for users.
+
+Queries are sent to the running facade if '[admin]' is enabled.
+Times use RFC3339 format, e.g. 2019-10-20T15:04:05Z`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		filter := &backend.AuditFilter{
+			User:          auditUser,
+			WorkPackageID: auditWorkPackage,
+			Since:         parseAuditTime(auditSince),
+			Until:         parseAuditTime(auditUntil),
+		}
+		showAuditLog(filter)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+
+	auditCmd.Flags().StringVar(&auditUser, "user", "", "only show changes for user")
+	auditCmd.Flags().IntVar(&auditWorkPackage, "work-package", 0, "only show changes to work package")
+	auditCmd.Flags().StringVar(&auditSince, "since", "", "only show changes after time")
+	auditCmd.Flags().StringVar(&auditUntil, "until", "", "only show changes before time")
+}
+
+func parseAuditTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("Invalid time '%s': %v", value, err)
+	}
+	return t
+}
+
+func showAuditLog(filter *backend.AuditFilter) {
+	res := adminRequest(&backend.AdminRequest{
+		Command: backend.AdminAudit,
+		Audit:   filter,
+	}, true)
+	for _, e := range res.Audit {
+		fmt.Printf("%s %s work-package=%d %s: %q -> %q: %s\n",
+			e.Time.Format(time.RFC3339), e.User, e.WorkPackageID,
+			e.Operation, e.Before, e.After, e.Result)
+	}
+}
@@ -10,6 +10,8 @@ import (
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+
+	"github.com/lectio/imap-facade-openproject/facade"
 )
 
 // dumpCmd represents the dump command
@@ -38,7 +40,23 @@ func init() {
 }
 
 func dumpAccount(cfg *viper.Viper, tlsEnabled bool, args []string) {
-	addr := cfg.GetString("address")
+	listeners, err := facade.ListenerConfigs(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Connect to the first tcp listener
+	var listener *facade.ListenerConfig
+	for i := range listeners {
+		if listeners[i].Network == "tcp" {
+			listener = &listeners[i]
+			break
+		}
+	}
+	if listener == nil {
+		log.Fatal("No tcp listener")
+	}
+	addr := listener.Address
+	mode := listener.TLSMode(tlsEnabled)
 
 	// If listen address is 0.0.0.0 connect to 127.0.0.1
 	addr = strings.Replace(addr, "0.0.0.0", "127.0.0.1", 1)
@@ -46,9 +64,8 @@ func dumpAccount(cfg *viper.Viper, tlsEnabled bool, args []string) {
 	log.Println("Connecting to server: ", addr)
 
 	var c *client.Client
-	var err error
 	// Connect to server
-	if tlsEnabled {
+	if mode == facade.TLSImplicit {
 		c, err = client.DialTLS(addr, nil)
 	} else {
 		c, err = client.Dial(addr)
@@ -56,6 +73,11 @@ func dumpAccount(cfg *viper.Viper, tlsEnabled bool, args []string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if mode == facade.TLSStartTLS {
+		if err := c.StartTLS(nil); err != nil {
+			log.Fatal(err)
+		}
+	}
 	log.Println("Connected")
 
 	// Don't forget to logout
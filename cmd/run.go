@@ -32,6 +32,17 @@ var runCmd = &cobra.Command{
 			// run imap server in goroutine
 			go s.Run()
 
+			// Optional metrics server
+			if cfgMetrics := viper.Sub("metrics"); cfgMetrics != nil && cfgMetrics.GetBool("enabled") {
+				go facade.RunMetricsServer(cfgMetrics.GetString("address"))
+			}
+
+			// Optional admin socket for the command line (e.g. audit log
+			// queries)
+			if cfgAdmin := viper.Sub("admin"); cfgAdmin != nil && cfgAdmin.GetBool("enabled") {
+				go s.RunAdminServer(cfgAdmin.GetString("socket"))
+			}
+
 			// Listen for shutdown signals
 			c := make(chan os.Signal, 1)
 			signal.Notify(c, os.Interrupt)
@@ -0,0 +1,12 @@
+<!doctype html>
+<html>
+  <head>
+		<base href="{{ base }}" target="_blank">
+    <title>{{ .Subject }}</title>
+  </head>
+  <body class="">
+<p><b>{{ .Activity.Author }}</b> | {{ .Date | date "02 January 2006 15:04" }}</p>
+{{ .Activity.Comment "html" }}
+<hr>
+  </body>
+</html>
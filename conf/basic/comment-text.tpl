@@ -0,0 +1,5 @@
+{{ .Activity.Author }} | {{ .Date | date "02 January 2006 15:04" }}
+
+{{ .Activity.Comment "text" }}
+
+---------------------------------------------------------
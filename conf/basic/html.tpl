@@ -9,5 +9,24 @@
 {{ .Date | date "02 January 2006" }} | {{ .ReadingTime }}
 {{ .Description "html" }}
 <hr>
+{{- if .Activities }}
+<h3>Activity</h3>
+{{- range .Activities }}
+<div class="activity">
+<p><b>{{ .Author }}</b> | {{ .Date | date "02 January 2006 15:04" }}</p>
+{{- with .Details "html" }}
+<ul>
+{{- range . }}
+  <li>{{ . }}</li>
+{{- end }}
+</ul>
+{{- end }}
+{{- if .HasComment }}
+{{ .Comment "html" }}
+{{- end }}
+</div>
+{{- end }}
+<hr>
+{{- end }}
   </body>
 </html>
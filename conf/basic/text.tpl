@@ -3,3 +3,17 @@
 {{ .Description "text" }}
 
 ---------------------------------------------------------
+{{- if .Activities }}
+Activity
+{{ range .Activities }}
+{{ .Author }} | {{ .Date | date "02 January 2006 15:04" }}
+{{- range .Details "text" }}
+  * {{ . }}
+{{- end }}
+{{- if .HasComment }}
+
+{{ .Comment "text" }}
+{{- end }}
+{{ end }}
+---------------------------------------------------------
+{{- end }}
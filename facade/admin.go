@@ -0,0 +1,80 @@
+package facade
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+// RunAdminServer serves admin commands from the command line (e.g. audit log
+// queries) at a unix socket.  The running facade keeps the cache db locked,
+// so the commands are handled by the facade.
+func (g *ImapFacade) RunAdminServer(path string) {
+	// Remove stale socket
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Only the facade's user may send admin commands.
+	if err := os.Chmod(path, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Starting admin server at:", path)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println("Admin server stopped:", err)
+			return
+		}
+		go g.serveAdmin(conn)
+	}
+}
+
+func (g *ImapFacade) serveAdmin(conn net.Conn) {
+	defer conn.Close()
+
+	var req backend.AdminRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		log.Println("Invalid admin request:", err)
+		return
+	}
+	res, err := g.backend.HandleAdmin(&req)
+	if err != nil {
+		res = &backend.AdminResponse{
+			Error: err.Error(),
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		log.Println("Failed to send admin response:", err)
+	}
+}
+
+// SendAdminRequest sends an admin command to the running facade.  Returns a
+// *net.OpError if the facade isn't running.
+func SendAdminRequest(path string, req *backend.AdminRequest) (*backend.AdminResponse, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var res backend.AdminResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+	return &res, nil
+}
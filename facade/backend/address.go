@@ -0,0 +1,49 @@
+package backend
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// addressPattern formats and parses email addresses with an `{id}`
+// placeholder.  For example: "reply+{id}@example.com"
+type addressPattern struct {
+	pattern string
+	match   *regexp.Regexp
+}
+
+func newAddressPattern(pattern string) *addressPattern {
+	p := &addressPattern{
+		pattern: pattern,
+	}
+	if pattern != "" {
+		expr := strings.Replace(regexp.QuoteMeta(pattern), `\{id\}`, `(\d+)`, 1)
+		p.match = regexp.MustCompile(`(?i)^` + expr + `$`)
+	}
+	return p
+}
+
+// Format returns the address for the id.  Returns an empty string if no
+// pattern is configured.
+func (p *addressPattern) Format(id int) string {
+	if p.pattern == "" {
+		return ""
+	}
+	return strings.Replace(p.pattern, `{id}`, strconv.Itoa(id), -1)
+}
+
+// Parse returns the id from the address.  Returns 0 if the address doesn't
+// match the pattern.
+func (p *addressPattern) Parse(addr string) int {
+	if p.match == nil {
+		return 0
+	}
+	addr = strings.Trim(strings.TrimSpace(addr), "<>")
+	m := p.match.FindStringSubmatch(addr)
+	if m == nil {
+		return 0
+	}
+	id, _ := strconv.Atoi(m[1])
+	return id
+}
@@ -0,0 +1,91 @@
+package backend
+
+import (
+	"fmt"
+)
+
+// Admin commands
+const (
+	AdminAudit             = "audit"
+	AdminCreateAppPassword = "create-app-password"
+	AdminListAppPasswords  = "list-app-passwords"
+	AdminRevokeAppPassword = "revoke-app-password"
+)
+
+// AdminRequest is a command from the command line, e.g. an audit log query.
+// It is sent to the admin socket of the running facade, so the cache db
+// doesn't need to be opened by another process.
+type AdminRequest struct {
+	Command string
+	Audit   *AuditFilter `json:",omitempty"`
+	// App password commands
+	User          string `json:",omitempty"`
+	Device        string `json:",omitempty"`
+	APIKey        string `json:",omitempty"`
+	AppPasswordID int    `json:",omitempty"`
+}
+
+// AdminResponse is the result of an admin command.
+type AdminResponse struct {
+	// Error message of failed commands.
+	Error string        `json:",omitempty"`
+	Audit []*AuditEntry `json:",omitempty"`
+	// Created app password, only returned once.
+	Password     string         `json:",omitempty"`
+	AppPasswords []*AppPassword `json:",omitempty"`
+}
+
+// HandleAdmin runs an admin command with the cache db.
+func (c *Cache) HandleAdmin(req *AdminRequest) (*AdminResponse, error) {
+	res := &AdminResponse{}
+	switch req.Command {
+	case AdminAudit:
+		filter := req.Audit
+		if filter == nil {
+			filter = &AuditFilter{}
+		}
+		entries, err := c.FindAuditEntries(filter)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to query audit log: %v", err)
+		}
+		res.Audit = entries
+	case AdminCreateAppPassword:
+		if req.User == "" || req.APIKey == "" {
+			return nil, fmt.Errorf("Missing username or API key")
+		}
+		password, ap, err := c.CreateAppPassword(req.User, req.Device, req.APIKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create app password: %v", err)
+		}
+		res.Password = password
+		res.AppPasswords = []*AppPassword{ap.withoutSecrets()}
+	case AdminListAppPasswords:
+		aps, err := c.FindAppPasswords(req.User)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list app passwords: %v", err)
+		}
+		for _, ap := range aps {
+			res.AppPasswords = append(res.AppPasswords, ap.withoutSecrets())
+		}
+	case AdminRevokeAppPassword:
+		ap, err := c.RevokeAppPassword(req.AppPasswordID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to revoke app password: %v", err)
+		}
+		res.AppPasswords = []*AppPassword{ap.withoutSecrets()}
+	default:
+		return nil, fmt.Errorf("Unknown admin command: %s", req.Command)
+	}
+	return res, nil
+}
+
+// HandleAdmin runs an admin command sent to the running facade.
+func (be *Backend) HandleAdmin(req *AdminRequest) (*AdminResponse, error) {
+	res, err := be.cache.HandleAdmin(req)
+	if err == nil && req.Command == AdminRevokeAppPassword {
+		// New logins of the user must authenticate again.  Connections that
+		// are already logged in aren't closed.
+		be.dropUser(res.AppPasswords[0].User)
+	}
+	return res, err
+}
@@ -0,0 +1,232 @@
+package backend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+)
+
+var (
+	// Allow logins with the OpenProject API key, not only app passwords.
+	apiKeyLogin = true
+
+	appPasswordEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// AppPassword is a per-device password of a user.  Only the hash of the
+// password is stored.  The user's OpenProject API key is encrypted with a key
+// derived from the password, so it can only be decrypted when logging in.
+type AppPassword struct {
+	Id       int    `storm:"id,increment"`
+	User     string `storm:"index"`
+	Device   string
+	Salt     []byte
+	Hash     []byte
+	APIKey   []byte
+	Created  time.Time
+	LastUsed time.Time
+	// Revoked app passwords are kept for listing, but can't be used.
+	Revoked time.Time
+}
+
+func (c *Cache) appPasswordNode() storm.Node {
+	return c.db.From("AppPasswords")
+}
+
+// CreateAppPassword creates a new app password for the user's device.  The
+// password is only returned here.
+func (c *Cache) CreateAppPassword(username, device, apiKey string) (string, *AppPassword, error) {
+	password, ap, err := newAppPassword(username, device, apiKey)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := c.appPasswordNode().Save(ap); err != nil {
+		return "", nil, err
+	}
+	return password, ap, nil
+}
+
+// newAppPassword generates a random app password, with the API key encrypted
+// by it.
+func newAppPassword(username, device, apiKey string) (string, *AppPassword, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	password := formatAppPassword(secret)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", nil, err
+	}
+	sealed, err := sealAPIKey(deriveAppPasswordKey("key", salt, password), apiKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ap := &AppPassword{
+		User:    username,
+		Device:  device,
+		Salt:    salt,
+		Hash:    deriveAppPasswordKey("hash", salt, password),
+		APIKey:  sealed,
+		Created: time.Now(),
+	}
+	return password, ap, nil
+}
+
+// FindAppPasswords returns the app passwords of the user, or of all users if
+// username is empty.
+func (c *Cache) FindAppPasswords(username string) ([]*AppPassword, error) {
+	var aps []*AppPassword
+	var err error
+	if username == "" {
+		err = c.appPasswordNode().All(&aps)
+	} else {
+		err = c.appPasswordNode().Find("User", username, &aps)
+	}
+	if err == storm.ErrNotFound {
+		return aps, nil
+	}
+	return aps, err
+}
+
+// RevokeAppPassword revokes an app password.
+func (c *Cache) RevokeAppPassword(id int) (*AppPassword, error) {
+	var ap AppPassword
+	if err := c.appPasswordNode().One("Id", id, &ap); err != nil {
+		return nil, err
+	}
+	if !ap.Revoked.IsZero() {
+		return nil, fmt.Errorf("App password %d already revoked", id)
+	}
+	ap.Revoked = time.Now()
+	if err := c.appPasswordNode().UpdateField(&ap, "Revoked", ap.Revoked); err != nil {
+		return nil, err
+	}
+	return &ap, nil
+}
+
+// checkAppPassword returns the API key of the user's app password.  Returns
+// false if the password isn't an app password of the user.
+func (c *Cache) checkAppPassword(username, password string) (string, bool, error) {
+	aps, err := c.FindAppPasswords(username)
+	if err != nil {
+		return "", false, err
+	}
+	ap, apiKey, err := matchAppPassword(aps, password)
+	if ap == nil || err != nil {
+		return "", false, err
+	}
+	if err := c.appPasswordNode().UpdateField(ap, "LastUsed", time.Now()); err != nil {
+		log.Println("Failed to update app password:", err)
+	}
+	return apiKey, true, nil
+}
+
+// matchAppPassword returns the app password matching the password, and its
+// decrypted API key.  Revoked app passwords don't match.
+func matchAppPassword(aps []*AppPassword, password string) (*AppPassword, string, error) {
+	for _, ap := range aps {
+		if !ap.Revoked.IsZero() {
+			continue
+		}
+		hash := deriveAppPasswordKey("hash", ap.Salt, password)
+		if subtle.ConstantTimeCompare(hash, ap.Hash) != 1 {
+			continue
+		}
+		apiKey, err := openAPIKey(deriveAppPasswordKey("key", ap.Salt, password), ap.APIKey)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to decrypt API key of app password %d: %v", ap.Id, err)
+		}
+		return ap, apiKey, nil
+	}
+	return nil, "", nil
+}
+
+// withoutSecrets returns a copy of the app password for listing.
+func (ap *AppPassword) withoutSecrets() *AppPassword {
+	info := *ap
+	info.Salt = nil
+	info.Hash = nil
+	info.APIKey = nil
+	return &info
+}
+
+// formatAppPassword formats the random secret in groups of 4 characters,
+// e.g. "abcd-efgh-...".
+func formatAppPassword(secret []byte) string {
+	encoded := strings.ToLower(appPasswordEncoding.EncodeToString(secret))
+	var groups []string
+	for len(encoded) > 4 {
+		groups = append(groups, encoded[:4])
+		encoded = encoded[4:]
+	}
+	groups = append(groups, encoded)
+	return strings.Join(groups, "-")
+}
+
+// normalizeAppPassword allows app passwords to be entered without dashes or
+// in upper case.
+func normalizeAppPassword(password string) string {
+	password = strings.ToLower(strings.TrimSpace(password))
+	password = strings.Replace(password, "-", "", -1)
+	return strings.Replace(password, " ", "", -1)
+}
+
+// deriveAppPasswordKey derives the hash ("hash") or encryption key ("key") of
+// an app password.  App passwords are random, so a salted SHA-256 is enough.
+func deriveAppPasswordKey(purpose string, salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write([]byte(purpose))
+	h.Write(salt)
+	h.Write([]byte(normalizeAppPassword(password)))
+	return h.Sum(nil)
+}
+
+// sealAPIKey encrypts the API key with AES-GCM.  The nonce is prepended.
+func sealAPIKey(key []byte, apiKey string) ([]byte, error) {
+	gcm, err := newAPIKeyCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, []byte(apiKey), nil), nil
+}
+
+func openAPIKey(key []byte, sealed []byte) (string, error) {
+	gcm, err := newAPIKeyCipher(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("Encrypted API key too short.")
+	}
+	nonce := sealed[:gcm.NonceSize()]
+	apiKey, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(apiKey), nil
+}
+
+func newAPIKeyCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSealAPIKey(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key := deriveAppPasswordKey("key", salt, "abcd-efgh")
+	sealed, err := sealAPIKey(key, "api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "api-key") {
+		t.Error("API key not encrypted")
+	}
+
+	apiKey, err := openAPIKey(key, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey != "api-key" {
+		t.Errorf("openAPIKey() = %q, want %q", apiKey, "api-key")
+	}
+
+	wrongKey := deriveAppPasswordKey("key", salt, "abcd-efgi")
+	if _, err := openAPIKey(wrongKey, sealed); err == nil {
+		t.Error("openAPIKey() with wrong key succeeded")
+	}
+	if _, err := openAPIKey(key, sealed[:4]); err == nil {
+		t.Error("openAPIKey() with truncated data succeeded")
+	}
+}
+
+func TestNormalizeAppPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{"abcd-efgh-ijkl", "abcdefghijkl"},
+		{"ABCD-EFGH-IJKL", "abcdefghijkl"},
+		{"abcd efgh ijkl", "abcdefghijkl"},
+		{" abcdefghijkl\n", "abcdefghijkl"},
+	}
+	for _, tt := range tests {
+		if got := normalizeAppPassword(tt.password); got != tt.want {
+			t.Errorf("normalizeAppPassword(%q) = %q, want %q", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAppPassword(t *testing.T) {
+	password, ap, err := newAppPassword("alice", "phone", "api-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(password) != 39 {
+		t.Errorf("app password %q: length %d, want 39", password, len(password))
+	}
+	other, otherAP, err := newAppPassword("alice", "laptop", "other-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aps := []*AppPassword{otherAP, ap}
+
+	tests := []struct {
+		name     string
+		password string
+		want     *AppPassword
+		apiKey   string
+	}{
+		{"password", password, ap, "api-key"},
+		{"other password", other, otherAP, "other-key"},
+		{"without dashes", strings.Replace(password, "-", "", -1), ap, "api-key"},
+		{"upper case", strings.ToUpper(password), ap, "api-key"},
+		{"wrong password", password[:len(password)-1] + "9", nil, ""},
+		{"API key", "api-key", nil, ""},
+		{"empty", "", nil, ""},
+	}
+	for _, tt := range tests {
+		got, apiKey, err := matchAppPassword(aps, tt.password)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want || apiKey != tt.apiKey {
+			t.Errorf("%s: matchAppPassword() = %v, %q, want %v, %q", tt.name, got, apiKey, tt.want, tt.apiKey)
+		}
+	}
+
+	// Revoked app passwords can't be used.
+	ap.Revoked = time.Now()
+	if got, apiKey, err := matchAppPassword(aps, password); got != nil || apiKey != "" || err != nil {
+		t.Errorf("revoked: matchAppPassword() = %v, %q, %v", got, apiKey, err)
+	}
+	if got, _, _ := matchAppPassword(aps, other); got != otherAP {
+		t.Error("revoking an app password revoked other app passwords")
+	}
+}
@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"log"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+)
+
+// AuditEntry records a change made to OpenProject for a user.
+type AuditEntry struct {
+	Id            int       `storm:"id,increment"`
+	Time          time.Time `storm:"index"`
+	User          string    `storm:"index"`
+	WorkPackageID int       `storm:"index"`
+	Operation     string
+	Before        string
+	After         string
+	// "ok", "read-only" or the error message.
+	Result string
+}
+
+// AuditFilter selects audit log entries.  Zero fields match all entries.
+type AuditFilter struct {
+	User          string
+	WorkPackageID int
+	Since         time.Time
+	Until         time.Time
+}
+
+func (c *Cache) auditNode() storm.Node {
+	return c.db.From("Audit")
+}
+
+// AddAuditEntry appends an entry to the audit log.
+func (c *Cache) AddAuditEntry(entry *AuditEntry) error {
+	return c.auditNode().Save(entry)
+}
+
+// FindAuditEntries returns the audit log entries matching the filter, oldest
+// first.
+func (c *Cache) FindAuditEntries(f *AuditFilter) ([]*AuditEntry, error) {
+	matchers := []q.Matcher{}
+	if f.User != "" {
+		matchers = append(matchers, q.Eq("User", f.User))
+	}
+	if f.WorkPackageID > 0 {
+		matchers = append(matchers, q.Eq("WorkPackageID", f.WorkPackageID))
+	}
+	if !f.Since.IsZero() {
+		matchers = append(matchers, q.Gte("Time", f.Since))
+	}
+	if !f.Until.IsZero() {
+		matchers = append(matchers, q.Lte("Time", f.Until))
+	}
+
+	var entries []*AuditEntry
+	err := c.auditNode().Select(matchers...).OrderBy("Time").Find(&entries)
+	if err == storm.ErrNotFound {
+		return entries, nil
+	}
+	return entries, err
+}
+
+func (be *Backend) audit(entry *AuditEntry) {
+	if err := be.cache.AddAuditEntry(entry); err != nil {
+		log.Println("Failed to add audit log entry:", err)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"io"
 	"log"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 
@@ -22,20 +24,42 @@ var (
 	emailPlaceHolder = "user-{id}@example.com"
 	activityName     = "Other"
 	wordsPerMinute   = 200.0
+
+	// Reply-To address of work package messages.
+	replyAddress = newAddressPattern("")
+	// Address for creating work packages in a project.
+	projectAddress = newAddressPattern("")
+
+	// Don't make changes in OpenProject, for all users or only the listed
+	// users.
+	readOnly      = false
+	readOnlyUsers = []string{}
+
+	// Parent mailbox for the mailboxes of archived/inaccessible projects.
+	// If empty, the mailboxes are removed.
+	archiveMailbox = "Archive"
+
+	// Status folders created in each project mailbox.
+	statusFolders = []string{}
+	// Status of work packages moved back to the project mailbox.
+	defaultStatus = "New"
 )
 
 type Backend struct {
 	sync.RWMutex
 
 	// OpenProject
-	base           string
-	updateInterval int
+	base             string
+	updateInterval   int
+	fullSyncInterval int
 
 	// Email template
 	emailTemplate *EmailTemplate
 
 	users map[string]*User
 
+	loginLimiter *loginLimiter
+
 	updates chan backend.Update
 
 	cache *Cache
@@ -52,32 +76,68 @@ func formatEmailAddress(u *hal.User) string {
 	return u.Name() + " <" + email + ">"
 }
 
-func (be *Backend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+func (be *Backend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	addr := remoteAddr(connInfo)
+	ip := remoteIP(connInfo)
+	if be.loginLimiter.isLocked(ip, username) {
+		log.Printf("--- Login locked: %s from %s", username, addr)
+		loginMetrics.Add("locked", 1)
+		return nil, errLoginLocked
+	}
+
+	user, err := be.login(username, password)
+	if err != nil {
+		log.Printf("--- Login failed: %s from %s: %v", username, addr, err)
+		loginMetrics.Add("failed", 1)
+		// Slow down password guessing.  Other logins aren't blocked.
+		time.Sleep(be.loginLimiter.failed(ip, username))
+		return nil, errBadLogin
+	}
+	log.Printf("--- Login ok: %s from %s", username, addr)
+	loginMetrics.Add("ok", 1)
+	be.loginLimiter.succeeded(username)
+	return user, nil
+}
+
+func (be *Backend) login(username, password string) (*User, error) {
 	be.Lock()
 	defer be.Unlock()
 
+	// App passwords map to the user's API key.
+	apiKey, ok, err := be.cache.checkAppPassword(username, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if !apiKeyLogin {
+			return nil, errors.New("Not an app password.")
+		}
+		apiKey = password
+	}
+
 	user, ok := be.users[username]
 	if ok {
-		// user already exists check password
-		if user.password == password {
-			log.Printf("--- Login ok: %s", username)
+		// user already exists check API key
+		if user.checkAPIKey(apiKey) {
 			return user, nil
 		}
 	}
-	// Haven't seen this user before, or password changed.
-	if user, err := be.checkUserLogin(username, password); err == nil {
-		log.Printf("--- Login ok: %s", username)
-		return user, nil
-	} else {
-		log.Printf("--- Login failed: %v", err)
-	}
+	// Haven't seen this user before, or API key changed.
+	return be.checkUserLogin(username, apiKey)
+}
 
-	return nil, errors.New("Bad username or password")
+// remoteAddr returns the client address of the connection.  With the PROXY
+// protocol this is the address of the client, not the proxy.
+func remoteAddr(connInfo *imap.ConnInfo) string {
+	if connInfo == nil || connInfo.RemoteAddr == nil {
+		return "unknown"
+	}
+	return connInfo.RemoteAddr.String()
 }
 
-func (be *Backend) checkUserLogin(username, password string) (*User, error) {
+func (be *Backend) checkUserLogin(username, apiKey string) (*User, error) {
 	c := hal.NewHalClient(be.base)
-	c.SetAPIKey(password)
+	c.SetAPIKey(apiKey)
 
 	res, err := c.Get("/api/v3/my_preferences")
 	if err != nil {
@@ -97,11 +157,27 @@ func (be *Backend) checkUserLogin(username, password string) (*User, error) {
 		return nil, errors.New("IMAP Username doesn't match OpenProject login.")
 	}
 
-	user := NewUser(be, c, userRes, password)
+	if old, ok := be.users[username]; ok {
+		old.stopUpdater()
+	}
+	user := NewUser(be, c, userRes, apiKey)
 	be.users[username] = user
 	return user, nil
 }
 
+// dropUser forgets the logged in user, so the next login has to authenticate
+// again, e.g. after revoking an app password.
+func (be *Backend) dropUser(username string) {
+	be.Lock()
+	defer be.Unlock()
+
+	if user, ok := be.users[username]; ok {
+		log.Printf("--- Drop logged in user: %s", username)
+		user.stopUpdater()
+		delete(be.users, username)
+	}
+}
+
 func (be *Backend) Updates() <-chan backend.Update {
 	return be.updates
 }
@@ -112,8 +188,25 @@ func (be *Backend) PushUpdate(update backend.Update) {
 	<-wait
 }
 
-func (be *Backend) GenerateMessage(u *User, w *hal.WorkPackage) (*Message, error) {
-	return be.emailTemplate.Generate(u, w)
+// isReadOnly checks if changes to OpenProject are disabled for the user.
+func (be *Backend) isReadOnly(username string) bool {
+	if readOnly {
+		return true
+	}
+	for _, name := range readOnlyUsers {
+		if name == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (be *Backend) GenerateMessage(u *User, w *hal.WorkPackage, activities []*Activity) (*Message, error) {
+	return be.emailTemplate.Generate(u, w, activities)
+}
+
+func (be *Backend) GenerateComment(u *User, w *hal.WorkPackage, act *Activity) (*Message, error) {
+	return be.emailTemplate.GenerateComment(u, w, act)
 }
 
 func (be *Backend) LoadAttachment(hc *hal.HalClient, at *hal.Attachment) (io.Reader, error) {
@@ -128,14 +221,64 @@ func (be *Backend) FindTimeEntryActivityURL(hc *hal.HalClient, name string) (*ha
 	return be.cache.FindTimeEntryActivityURL(hc, name)
 }
 
+func (be *Backend) FindNamedResourceURL(hc *hal.HalClient, url string, name string) (*hal.Link, error) {
+	return be.cache.FindNamedResourceURL(hc, url, name)
+}
+
 func (be *Backend) Close() {
 	be.cache.Close()
 }
 
 func New(cfg *viper.Viper) *Backend {
 	base := cfg.GetString("base")
+	if u, err := url.Parse(base); err == nil && u.Hostname() != "" {
+		messageIDHost = u.Hostname()
+	}
 	emailDomain = cfg.GetString("emailDomain")
 	emailPlaceHolder = cfg.GetString("emailPlaceHolder")
+	replyAddress = newAddressPattern(cfg.GetString("replyAddress"))
+	projectAddress = newAddressPattern(cfg.GetString("projectAddress"))
+
+	if err := cfg.UnmarshalKey("flagMap", &flagMap); err != nil {
+		log.Panicf("Failed to load flag mapping: %v", err)
+	}
+	for _, m := range flagMap {
+		if _, ok := fieldCollections[m.Field]; !ok {
+			log.Panicf("Unsupported flag mapping field: %s", m.Field)
+		}
+	}
+
+	if name := cfg.GetString("flagStore"); name != "" {
+		if !isFlagStoreType(name) {
+			log.Panicf("Unsupported flag store: %s", name)
+		}
+		flagStoreType = name
+	}
+	flagCustomField = cfg.GetString("flagCustomField")
+	if flagStoreType == "customField" && flagCustomField == "" {
+		log.Panicf("The customField flag store requires 'flagCustomField'")
+	}
+
+	if cfg.IsSet("apiKeyLogin") {
+		apiKeyLogin = cfg.GetBool("apiKeyLogin")
+	}
+
+	readOnly = cfg.GetBool("readOnly")
+	readOnlyUsers = cfg.GetStringSlice("readOnlyUsers")
+	if readOnly {
+		log.Println("OpenProject Backend is read-only.")
+	}
+
+	if cfg.IsSet("archiveMailbox") {
+		archiveMailbox = cfg.GetString("archiveMailbox")
+	}
+
+	statusFolders = cfg.GetStringSlice("statusFolders")
+	defaultStatus = cfg.GetString("defaultStatus")
+	if defaultStatus == "" {
+		// Default to "New"
+		defaultStatus = "New"
+	}
 
 	activityName = cfg.GetString("timeEntryActivity")
 	if activityName == "" {
@@ -147,6 +290,12 @@ func New(cfg *viper.Viper) *Backend {
 		wordsPerMinute = 200.0
 	}
 
+	fullSyncInterval := cfg.GetInt("fullSyncInterval")
+	if fullSyncInterval == 0 {
+		// Default to a full sync every hour.
+		fullSyncInterval = 3600
+	}
+
 	tpl, err := NewEmailTemplate(cfg)
 	if err != nil {
 		log.Panicf("Failed to load email templates: %v", err)
@@ -157,11 +306,13 @@ func New(cfg *viper.Viper) *Backend {
 	log.Println("OpenProject Backend: ", base)
 
 	return &Backend{
-		base:           base,
-		updateInterval: cfg.GetInt("updateInterval"),
-		users:          make(map[string]*User),
-		updates:        make(chan backend.Update),
-		emailTemplate:  tpl,
-		cache:          cache,
+		base:             base,
+		updateInterval:   cfg.GetInt("updateInterval"),
+		fullSyncInterval: fullSyncInterval,
+		users:            make(map[string]*User),
+		loginLimiter:     newLoginLimiter(cfg.Sub("loginLimit")),
+		updates:          make(chan backend.Update),
+		emailTemplate:    tpl,
+		cache:            cache,
 	}
 }
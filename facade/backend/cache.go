@@ -11,6 +11,7 @@ import (
 	"github.com/asdine/storm"
 	hal "github.com/lectio/go-json-hal"
 	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
 )
 
 var (
@@ -64,6 +65,45 @@ func (c *Cache) FindTimeEntryActivityURL(hc *hal.HalClient, name string) (*hal.L
 	return nil, fmt.Errorf("Failed to find Time Entry Activity: %s", name)
 }
 
+// FindNamedResourceURL finds the resource with the name in the collection,
+// e.g. a status in "/api/v3/statuses".
+func (c *Cache) FindNamedResourceURL(hc *hal.HalClient, url string, name string) (*hal.Link, error) {
+	var link *hal.Link
+	key := url + "#" + name
+
+	// Try getting it from the cache
+	if err := c.db.Get("namedResources", key, &link); err == nil {
+		return link, nil
+	}
+
+	col, err := hc.GetCollection(url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get %s: %v", url, err)
+	}
+	for _, res := range col.Items() {
+		named, ok := res.(interface {
+			GetLink(name string) *hal.Link
+		})
+		if !ok {
+			continue
+		}
+		// The title of the 'self' link is the resource's name.
+		if self := named.GetLink("self"); self != nil && self.Title == name {
+			link = self
+			break
+		}
+	}
+	// Cache resource url if found
+	if link != nil {
+		if err := c.db.Set("namedResources", key, &link); err != nil {
+			return nil, fmt.Errorf("Failed to cache resource url: %v", err)
+		}
+		return link, nil
+	}
+
+	return nil, fmt.Errorf("Failed to find '%s' in %s", name, url)
+}
+
 func (c *Cache) LoadCachedAddress(hc *hal.HalClient, link *hal.Link) (string, error) {
 	if link == nil || link.Href == "" {
 		return "", nil
@@ -159,9 +199,13 @@ func NewCache(cfg *viper.Viper) *Cache {
 
 	cache := &Cache{}
 
-	// Open boltdb
+	// Open boltdb.  Don't wait forever if another process (e.g. a command
+	// line tool) has it open.
 	file := cfg.GetString("db")
-	if db, err := storm.Open(file); err != nil {
+	opts := &bolt.Options{
+		Timeout: 10 * time.Second,
+	}
+	if db, err := storm.Open(file, storm.BoltOptions(0600, opts)); err != nil {
 		log.Fatal("Failed to open cache db:", err)
 		return nil
 	} else {
@@ -170,3 +214,36 @@ func NewCache(cfg *viper.Viper) *Cache {
 
 	return cache
 }
+
+// OpenReadOnlyCache opens the cache db for reading, e.g. to query the audit
+// log.  Fails if the facade has the db open.
+func OpenReadOnlyCache(cfg *viper.Viper) (*Cache, error) {
+	return openCache(cfg, true)
+}
+
+// OpenCache opens the cache db for changes from the command line, e.g. to
+// create app passwords.  Fails if the facade has the db open.
+func OpenCache(cfg *viper.Viper) (*Cache, error) {
+	return openCache(cfg, false)
+}
+
+func openCache(cfg *viper.Viper, readOnly bool) (*Cache, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("Missing cache settings.")
+	}
+	file := cfg.GetString("db")
+	opts := &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: readOnly,
+	}
+	db, err := storm.Open(file, storm.BoltOptions(0600, opts))
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("Failed to open cache db: in use by the running facade, enable '[admin]' to send commands to it")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open cache db: %v", err)
+	}
+	return &Cache{
+		db: db,
+	}, nil
+}
@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	hal "github.com/lectio/go-json-hal"
+)
+
+// flagMapping maps an IMAP flag to the value of a work package field.
+type flagMapping struct {
+	// IMAP flag or keyword, e.g. `\Flagged`
+	Flag string
+	// Work package field: priority, status, type or category
+	Field string
+	// Field value when the flag is set.
+	Value string
+	// Field value when the flag is removed.  Optional.
+	UnsetValue string
+}
+
+var (
+	flagMap = []*flagMapping{}
+
+	// Collections with the values of the mapped fields.  `%d` is the
+	// project id.
+	fieldCollections = map[string]string{
+		"priority": "/api/v3/priorities",
+		"status":   "/api/v3/statuses",
+		"type":     "/api/v3/types",
+		"category": "/api/v3/projects/%d/categories",
+	}
+)
+
+// hasMappedFlag checks if any of the flags is mapped to a field.
+func hasMappedFlag(flags []string) bool {
+	for _, flag := range flags {
+		if isMappedFlag(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedFlags returns the flags that were added or removed.
+func changedFlags(before, after []string) []string {
+	var changed []string
+	for _, flag := range before {
+		if !hasFlag(after, flag) {
+			changed = append(changed, flag)
+		}
+	}
+	for _, flag := range after {
+		if !hasFlag(before, flag) {
+			changed = append(changed, flag)
+		}
+	}
+	return changed
+}
+
+func isMappedFlag(flag string) bool {
+	for _, m := range flagMap {
+		if m.Flag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValue returns the name of the work package's field value.
+func fieldValue(w *hal.WorkPackage, field string) string {
+	if link := w.GetLink(field); link != nil {
+		return link.Title
+	}
+	return ""
+}
+
+// applyFieldFlags replaces the mapped flags with the flags for the work
+// package's field values.
+func applyFieldFlags(flags []string, w *hal.WorkPackage) []string {
+	if len(flagMap) == 0 {
+		return flags
+	}
+	newFlags := []string{}
+	for _, flag := range flags {
+		if !isMappedFlag(flag) {
+			newFlags = append(newFlags, flag)
+		}
+	}
+	for _, m := range flagMap {
+		if fieldValue(w, m.Field) == m.Value && !hasFlag(newFlags, m.Flag) {
+			newFlags = append(newFlags, m.Flag)
+		}
+	}
+	return newFlags
+}
+
+// updateWorkPackageFields changes the work package fields mapped to the
+// message's flags.  Only done if a mapped flag was changed.
+func (u *User) updateWorkPackageFields(msg *Message, changed []string) error {
+	if !hasMappedFlag(changed) {
+		return nil
+	}
+	w, err := u.getWorkPackage(msg.WorkPackageID)
+	if err != nil {
+		return err
+	}
+
+	changes := make(map[string]string)
+	// Removed flags first, so set flags win.
+	for _, m := range flagMap {
+		if m.UnsetValue != "" && !hasFlag(msg.Flags, m.Flag) && fieldValue(w, m.Field) == m.Value {
+			changes[m.Field] = m.UnsetValue
+		}
+	}
+	for _, m := range flagMap {
+		if hasFlag(msg.Flags, m.Flag) && fieldValue(w, m.Field) != m.Value {
+			changes[m.Field] = m.Value
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var before, after []string
+	for field, value := range changes {
+		url := fieldCollections[field]
+		if field == "category" {
+			url = fmt.Sprintf(url, linkID(w.GetLink("project")))
+		}
+		link, err := u.backend.FindNamedResourceURL(u.hal, url, value)
+		if err != nil {
+			return err
+		}
+		log.Printf("--- Change %s of work package %d to: %s", field, msg.WorkPackageID, value)
+		before = append(before, field+"="+fieldValue(w, field))
+		after = append(after, field+"="+value)
+		w.SetLink(field, link.Href)
+	}
+	entry := &AuditEntry{
+		WorkPackageID: msg.WorkPackageID,
+		Operation:     "change fields",
+		Before:        strings.Join(before, ", "),
+		After:         strings.Join(after, ", "),
+	}
+	return u.writeBack(entry, func() error {
+		res, err := w.Update(u.hal)
+		if err != nil {
+			return err
+		}
+		// Keep the message from being generated again.
+		if t := workPackageUpdatedAt(res); !t.IsZero() {
+			msg.UpdatedAt = t
+		}
+		return nil
+	})
+}
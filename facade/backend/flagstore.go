@@ -0,0 +1,278 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/emersion/go-imap"
+	hal "github.com/lectio/go-json-hal"
+)
+
+var (
+	// Storage for message flags: timeEntry, local or customField
+	flagStoreType = "timeEntry"
+	// Custom field used by the customField flag store, e.g. "customField1"
+	flagCustomField = ""
+)
+
+// FlagStore stores the IMAP flags of work package messages.
+type FlagStore interface {
+	// LoadFlags returns the stored flags of the work package.  Returns nil if
+	// no flags are stored.
+	LoadFlags(w *hal.WorkPackage) ([]string, error)
+	// SaveFlags stores the flags of a work package message.
+	SaveFlags(msg *Message) error
+}
+
+func isFlagStoreType(name string) bool {
+	switch name {
+	case "timeEntry", "local", "customField":
+		return true
+	}
+	return false
+}
+
+func newFlagStore(u *User) FlagStore {
+	var store FlagStore
+	switch flagStoreType {
+	case "local":
+		return &localFlagStore{
+			store: u.store,
+		}
+	case "customField":
+		store = &customFieldFlagStore{
+			user:  u,
+			field: flagCustomField,
+		}
+	default:
+		store = newTimeEntryFlagStore(u)
+	}
+	if u.readOnly {
+		// Don't create time entries or change custom fields.
+		log.Printf("--- Read-only: flags of user %s are only stored locally", u.username)
+		return &readOnlyFlagStore{
+			store: store,
+			local: &localFlagStore{
+				store: u.store,
+			},
+		}
+	}
+	return store
+}
+
+// readOnlyFlagStore loads flags from OpenProject, but only stores changes
+// locally.  Locally changed flags take precedence.
+type readOnlyFlagStore struct {
+	store FlagStore
+	local *localFlagStore
+}
+
+func (s *readOnlyFlagStore) LoadFlags(w *hal.WorkPackage) ([]string, error) {
+	flags, err := s.local.LoadFlags(w)
+	if err != nil || flags != nil {
+		return flags, err
+	}
+	return s.store.LoadFlags(w)
+}
+
+func (s *readOnlyFlagStore) SaveFlags(msg *Message) error {
+	// Store no flags as an empty list, so they still override the flags in
+	// OpenProject.
+	stored := *msg
+	stored.Flags = append([]string{}, msg.Flags...)
+	return s.local.SaveFlags(&stored)
+}
+
+// timeEntryFlagStore stores flags in the comment of a time entry for each
+// work package.  The 'Time tracking' module must be enabled for the project.
+type timeEntryFlagStore struct {
+	user *User
+}
+
+func newTimeEntryFlagStore(u *User) *timeEntryFlagStore {
+	// Get time entry activity url
+	if actLink, err := u.backend.FindTimeEntryActivityURL(u.hal, activityName); err == nil {
+		u.activity = actLink
+	} else {
+		log.Fatal("Failed to find time entry activity url:", err)
+	}
+
+	// Load time entries
+	if err := u.loadTimeEntries(); err != nil {
+		log.Println("Error loading user's time entries:", err)
+	}
+
+	return &timeEntryFlagStore{
+		user: u,
+	}
+}
+
+func (s *timeEntryFlagStore) LoadFlags(w *hal.WorkPackage) ([]string, error) {
+	u := s.user
+	u.teLock.Lock()
+	defer u.teLock.Unlock()
+
+	te, _ := u.getTimeEntry(w.Id(), false)
+	if te == nil {
+		// no time entry or error.
+		return nil, nil
+	}
+	comment := te.Comment()
+	if comment != nil && comment.Raw != "" {
+		return strings.Split(comment.Raw, ","), nil
+	}
+	return nil, nil
+}
+
+func (s *timeEntryFlagStore) SaveFlags(msg *Message) error {
+	u := s.user
+	u.teLock.Lock()
+	defer u.teLock.Unlock()
+
+	te, err := u.getTimeEntry(msg.WorkPackageID, true)
+	if err != nil {
+		return err
+	}
+	var before string
+	if comment := te.Comment(); comment != nil {
+		before = comment.Raw
+	}
+	flags := strings.Join(msg.Flags, ",")
+	te.SetComment("plain", flags, flags)
+
+	// Check for 'Seen' flag
+	if hasFlag(msg.Flags, imap.SeenFlag) {
+		te.SetHours(msg.ReadingTime())
+		te.SetSpentOn(time.Now())
+	} else {
+		te.SetHours(0)
+	}
+
+	// Record changes.
+	entry := &AuditEntry{
+		WorkPackageID: msg.WorkPackageID,
+		Operation:     "update time entry flags",
+		Before:        before,
+		After:         flags,
+	}
+	err = u.writeBack(entry, func() error {
+		res, err := te.Update(u.hal)
+		if err != nil {
+			return err
+		}
+		// Store updated time entry
+		if updatedEntry, ok := res.(*hal.TimeEntry); ok {
+			te = updatedEntry
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Get Work package url
+	workLink := te.GetLink("workPackage")
+	if workLink == nil {
+		// Not a work package time entry, ignore it.
+		return fmt.Errorf("Updated time entry missing work package url.")
+	}
+	workURL := workLink.Href
+
+	// Store updated time entry
+	u.timeEntries[workURL] = te
+
+	return nil
+}
+
+// localFlagStore stores flags only in the facade's cache.
+type localFlagStore struct {
+	store storm.Node
+}
+
+func (s *localFlagStore) LoadFlags(w *hal.WorkPackage) ([]string, error) {
+	var flags []string
+	if err := s.store.Get("flags", w.Id(), &flags); err != nil {
+		if err == storm.ErrNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return flags, nil
+}
+
+func (s *localFlagStore) SaveFlags(msg *Message) error {
+	return s.store.Set("flags", msg.WorkPackageID, msg.Flags)
+}
+
+// customFieldFlagStore stores flags in a "String" custom field of the work
+// packages.  "Long text" fields are formattable objects, not strings, and
+// can't be used.  The custom field must be enabled for the projects.  The
+// field has the flags of each user as JSON, e.g. `{"alice":["\\Seen"]}`.
+type customFieldFlagStore struct {
+	user  *User
+	field string
+}
+
+// customFieldFlags returns the flags of all users stored in the field.
+func (s *customFieldFlagStore) customFieldFlags(w *hal.WorkPackage) map[string][]string {
+	flags := make(map[string][]string)
+	value := w.GetString(s.field)
+	if value == "" {
+		return flags
+	}
+	if err := json.Unmarshal([]byte(value), &flags); err != nil {
+		log.Printf("Invalid flags in custom field of work package %d: %v", w.Id(), err)
+		return make(map[string][]string)
+	}
+	return flags
+}
+
+func (s *customFieldFlagStore) LoadFlags(w *hal.WorkPackage) ([]string, error) {
+	return s.customFieldFlags(w)[s.user.username], nil
+}
+
+func (s *customFieldFlagStore) SaveFlags(msg *Message) error {
+	u := s.user
+	w, err := u.getWorkPackage(msg.WorkPackageID)
+	if err != nil {
+		return err
+	}
+	all := s.customFieldFlags(w)
+	before := strings.Join(all[u.username], ",")
+	after := strings.Join(msg.Flags, ",")
+	if before == after {
+		return nil
+	}
+	if len(msg.Flags) > 0 {
+		all[u.username] = msg.Flags
+	} else {
+		delete(all, u.username)
+	}
+	value, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+
+	entry := &AuditEntry{
+		WorkPackageID: msg.WorkPackageID,
+		Operation:     "update custom field flags",
+		Before:        before,
+		After:         after,
+	}
+	return u.writeBack(entry, func() error {
+		w.SetString(s.field, string(value))
+		res, err := w.Update(u.hal)
+		if err != nil {
+			return err
+		}
+		// The update changes the work package's 'updatedAt'.  Keep the
+		// message from being generated again.
+		if t := workPackageUpdatedAt(res); !t.IsZero() {
+			msg.UpdatedAt = t
+		}
+		return nil
+	})
+}
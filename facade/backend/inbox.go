@@ -0,0 +1,152 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// localFlags only apply to one copy of a message.  They aren't shared with
+// the other copies or stored in OpenProject, so a message expunged from one
+// mailbox isn't deleted in the others.
+var localFlags = []string{imap.DeletedFlag, imap.RecentFlag}
+
+// sharedFlags returns the flags without the local flags.
+func sharedFlags(flags []string) []string {
+	shared := make([]string, 0, len(flags))
+	for _, f := range flags {
+		if !hasFlag(localFlags, f) {
+			shared = append(shared, f)
+		}
+	}
+	return shared
+}
+
+// mergeSharedFlags returns the shared flags plus the local flags of the
+// message copy.
+func mergeSharedFlags(current, shared []string) []string {
+	flags := sharedFlags(shared)
+	for _, f := range localFlags {
+		if hasFlag(current, f) {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// syncInbox puts a copy of every work package message from the project
+// mailboxes in INBOX.  Copies of messages removed from the project mailboxes
+// are expunged.
+func (u *User) syncInbox() {
+	u.RLock()
+	defer u.RUnlock()
+
+	inbox, ok := u.mailboxes["INBOX"]
+	if !ok {
+		return
+	}
+
+	// Work package messages already in INBOX
+	have := make(map[messageKey]time.Time)
+	inbox.RLock()
+	for _, msg := range inbox.msgs {
+		if msg.WorkPackageID > 0 {
+			have[msg.key()] = msg.UpdatedAt
+		}
+	}
+	inbox.RUnlock()
+
+	// Copy new and changed messages from the project mailboxes.
+	keep := make(map[messageKey]bool)
+	flags := make(map[messageKey][]string)
+	var copies []*Message
+	for _, mbox := range u.mailboxes {
+		if mbox == inbox || mbox.ProjectID == 0 || mbox.Archived {
+			continue
+		}
+		mbox.RLock()
+		for _, msg := range mbox.msgs {
+			if msg.WorkPackageID == 0 {
+				continue
+			}
+			key := msg.key()
+			keep[key] = true
+			if updatedAt, ok := have[key]; ok && updatedAt.Equal(msg.UpdatedAt) {
+				flags[key] = sharedFlags(msg.Flags)
+				continue
+			}
+			msgCopy := msg.copy()
+			msgCopy.Flags = sharedFlags(msg.Flags)
+			copies = append(copies, msgCopy)
+		}
+		mbox.RUnlock()
+	}
+
+	inbox.syncCopies(copies, flags, keep)
+}
+
+// syncCopies adds the new copies to the mailbox, replacing older copies of
+// the same messages.  Copies that aren't in `keep` are expunged.
+func (mbox *Mailbox) syncCopies(copies []*Message, flags map[messageKey][]string, keep map[messageKey]bool) {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	// Remove copies of messages that are gone.
+	for i := len(mbox.msgs) - 1; i >= 0; i-- {
+		msg := mbox.msgs[i]
+		if msg.WorkPackageID > 0 && !keep[msg.key()] {
+			mbox.removeMessage(msg)
+		}
+	}
+
+	// Flags might have been changed in OpenProject.
+	for i, msg := range mbox.msgs {
+		f, ok := flags[msg.key()]
+		if !ok {
+			continue
+		}
+		if f = mergeSharedFlags(msg.Flags, f); !CompareFlags(f, msg.Flags) {
+			msg.Flags = f
+			mbox.pushFlagsUpdate(true, msg, uint32(i+1))
+		}
+	}
+
+	if len(copies) == 0 {
+		return
+	}
+	for _, msg := range copies {
+		if old := mbox.lookupMessage(msg.key()); old != nil {
+			mbox.removeMessage(old)
+		}
+		// Get a new UID in this mailbox.
+		msg.Uid = 0
+		mbox.appendMessage(msg)
+		mbox.mapMessage(msg)
+	}
+	mbox.saveMailbox()
+	mbox.user.PushMailboxUpdate(mbox)
+}
+
+// shareFlags sets the flags of the copies of the changed messages in all
+// other mailboxes.
+func (u *User) shareFlags(src *Mailbox, changed map[messageKey][]string) {
+	u.RLock()
+	defer u.RUnlock()
+
+	for _, mbox := range u.mailboxes {
+		if mbox != src {
+			mbox.setSharedFlags(changed)
+		}
+	}
+}
+
+// shareUpdatedAt sets the 'updatedAt' of the copies of work package messages
+// in all mailboxes.
+func (u *User) shareUpdatedAt(updated map[int]time.Time) {
+	u.RLock()
+	defer u.RUnlock()
+
+	for _, mbox := range u.mailboxes {
+		mbox.setUpdatedAt(updated)
+	}
+}
@@ -0,0 +1,97 @@
+package backend
+
+// workIndex tracks which project mailbox (or status folder) has the messages
+// of each work package, and the mailbox of each project.  Used to follow work
+// packages that move between projects.
+type workIndex struct {
+	// Map WorkPackage ID to mailbox
+	workPackages map[int]*Mailbox
+	// Map Project ID to project mailbox
+	projects map[int]*Mailbox
+}
+
+func newWorkIndex() *workIndex {
+	return &workIndex{
+		workPackages: make(map[int]*Mailbox),
+		projects:     make(map[int]*Mailbox),
+	}
+}
+
+// indexMailbox adds the work packages of a project mailbox to the index.
+func (u *User) indexMailbox(mbox *Mailbox) {
+	if mbox.ProjectID == 0 || mbox.isVirtual() {
+		return
+	}
+	ids := mbox.workPackageIDs()
+
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+	if mbox.StatusName == "" {
+		u.index.projects[mbox.ProjectID] = mbox
+	}
+	for _, id := range ids {
+		u.index.workPackages[id] = mbox
+	}
+}
+
+func (u *User) indexWorkPackage(id int, mbox *Mailbox) {
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+
+	u.index.workPackages[id] = mbox
+}
+
+// unindexWorkPackage removes the work package from the index, if it is in the
+// mailbox.
+func (u *User) unindexWorkPackage(id int, mbox *Mailbox) {
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+
+	if u.index.workPackages[id] == mbox {
+		delete(u.index.workPackages, id)
+	}
+}
+
+// lookupWorkPackage returns the mailbox with the work package's messages.
+func (u *User) lookupWorkPackage(id int) *Mailbox {
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+
+	return u.index.workPackages[id]
+}
+
+// lookupProject returns the project's mailbox.
+func (u *User) lookupProject(projectID int) *Mailbox {
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+
+	return u.index.projects[projectID]
+}
+
+// unindexProject removes the project mailbox and its work packages from the
+// index.
+func (u *User) unindexProject(mbox *Mailbox) {
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+
+	if u.index.projects[mbox.ProjectID] == mbox {
+		delete(u.index.projects, mbox.ProjectID)
+	}
+	for id, m := range u.index.workPackages {
+		if m.ProjectID == mbox.ProjectID {
+			delete(u.index.workPackages, id)
+		}
+	}
+}
+
+// projectMailboxes returns the mailboxes of all projects.
+func (u *User) projectMailboxes() []*Mailbox {
+	u.indexLock.Lock()
+	defer u.indexLock.Unlock()
+
+	mboxes := make([]*Mailbox, 0, len(u.index.projects))
+	for _, mbox := range u.index.projects {
+		mboxes = append(mboxes, mbox)
+	}
+	return mboxes
+}
@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/emersion/go-imap"
+)
+
+var (
+	errBadLogin    = errors.New("Bad username or password")
+	errLoginLocked = errors.New("Too many failed logins, try again later")
+
+	// Login metrics: ok, failed, locked (rejected logins) and lockouts.
+	loginMetrics = expvar.NewMap("login")
+
+	// Random key for hashing the API keys of logged in users.
+	apiKeyHashKey = randomKey()
+)
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Panicf("Failed to generate random key: %v", err)
+	}
+	return key
+}
+
+// hashAPIKey hashes the API key, so logged in users don't keep it in plain
+// text for checking logins.
+func hashAPIKey(apiKey string) []byte {
+	mac := hmac.New(sha256.New, apiKeyHashKey)
+	mac.Write([]byte(apiKey))
+	return mac.Sum(nil)
+}
+
+func (u *User) checkAPIKey(apiKey string) bool {
+	return hmac.Equal(u.apiKeyHash, hashAPIKey(apiKey))
+}
+
+// loginFailures counts the failed logins of an IP or username.
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter slows down and locks out clients guessing passwords.  Without
+// it every failed login would be checked against OpenProject.
+type loginLimiter struct {
+	sync.Mutex
+
+	// Failed logins before a lockout.  0 disables the lockout.
+	maxIPFailures   int
+	maxUserFailures int
+	lockout         time.Duration
+	// Delay after a failed login, doubled for each failure.
+	delay    time.Duration
+	maxDelay time.Duration
+	// Failures are forgotten after this time without new failures.
+	window time.Duration
+
+	ips       map[string]*loginFailures
+	users     map[string]*loginFailures
+	lastSweep time.Time
+
+	// Current time, replaced in tests.
+	now func() time.Time
+}
+
+func newLoginLimiter(cfg *viper.Viper) *loginLimiter {
+	l := &loginLimiter{
+		maxIPFailures:   20,
+		maxUserFailures: 10,
+		lockout:         15 * time.Minute,
+		delay:           time.Second,
+		maxDelay:        30 * time.Second,
+		window:          15 * time.Minute,
+		ips:             make(map[string]*loginFailures),
+		users:           make(map[string]*loginFailures),
+		now:             time.Now,
+	}
+	if cfg == nil {
+		return l
+	}
+	if cfg.IsSet("maxFailuresPerIP") {
+		l.maxIPFailures = cfg.GetInt("maxFailuresPerIP")
+	}
+	if cfg.IsSet("maxFailuresPerUser") {
+		l.maxUserFailures = cfg.GetInt("maxFailuresPerUser")
+	}
+	if cfg.IsSet("lockout") {
+		l.lockout = time.Duration(cfg.GetInt("lockout")) * time.Second
+	}
+	if cfg.IsSet("delay") {
+		l.delay = time.Duration(cfg.GetFloat64("delay") * float64(time.Second))
+	}
+	if cfg.IsSet("maxDelay") {
+		l.maxDelay = time.Duration(cfg.GetFloat64("maxDelay") * float64(time.Second))
+	}
+	if cfg.IsSet("window") {
+		l.window = time.Duration(cfg.GetInt("window")) * time.Second
+	}
+	return l
+}
+
+func (f *loginFailures) isLocked(now time.Time) bool {
+	return f != nil && now.Before(f.lockedUntil)
+}
+
+// isLocked checks if logins from the IP or for the username are locked out.
+// A locked username is only locked for IPs with recent failed logins, so
+// others can't lock a user out by guessing the password.
+func (l *loginLimiter) isLocked(ip, username string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	f := l.ips[ip]
+	if f.isLocked(now) {
+		return true
+	}
+	if f == nil || now.Sub(f.last) > l.window {
+		return false
+	}
+	return l.users[username].isLocked(now)
+}
+
+// failed records a failed login.  Returns the delay before answering the
+// client.
+func (l *loginLimiter) failed(ip, username string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	count := l.record(l.ips, ip, l.maxIPFailures, now)
+	if c := l.record(l.users, username, l.maxUserFailures, now); c > count {
+		count = c
+	}
+
+	delay := l.delay
+	for i := 1; i < count && delay < l.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.maxDelay {
+		delay = l.maxDelay
+	}
+	return delay
+}
+
+// succeeded forgets the failed logins of the username.  Failures of the IP
+// are kept, so one valid account can't be used to keep guessing others.
+func (l *loginLimiter) succeeded(username string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.users, username)
+}
+
+func (l *loginLimiter) record(failures map[string]*loginFailures, key string, max int, now time.Time) int {
+	f, ok := failures[key]
+	if !ok || now.Sub(f.last) > l.window {
+		f = &loginFailures{}
+		failures[key] = f
+	}
+	f.count++
+	f.last = now
+	if max > 0 && f.count >= max && !f.isLocked(now) {
+		log.Printf("--- Login lockout: %s for %v", key, l.lockout)
+		loginMetrics.Add("lockouts", 1)
+		f.lockedUntil = now.Add(l.lockout)
+	}
+	return f.count
+}
+
+// sweep removes expired failures, at most once a minute.
+func (l *loginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for _, failures := range []map[string]*loginFailures{l.ips, l.users} {
+		for key, f := range failures {
+			if now.Sub(f.last) > l.window && !f.isLocked(now) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// remoteIP returns the IP of the client, used for counting failed logins.
+func remoteIP(connInfo *imap.ConnInfo) string {
+	addr := remoteAddr(connInfo)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLoginLimiter(now *time.Time) *loginLimiter {
+	l := newLoginLimiter(nil)
+	l.now = func() time.Time {
+		return *now
+	}
+	return l
+}
+
+func TestLoginLimiterDelay(t *testing.T) {
+	now := time.Date(2019, 10, 14, 10, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+
+	want := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		30 * time.Second,
+		30 * time.Second,
+	}
+	for i, w := range want {
+		if got := l.failed("192.0.2.1", "alice"); got != w {
+			t.Errorf("failure %d: delay = %v, want %v", i+1, got, w)
+		}
+		now = now.Add(time.Second)
+	}
+}
+
+func TestLoginLimiterWindow(t *testing.T) {
+	now := time.Date(2019, 10, 14, 10, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+
+	l.failed("192.0.2.1", "alice")
+	now = now.Add(l.window - time.Second)
+	if got := l.failed("192.0.2.1", "alice"); got != 2*time.Second {
+		t.Errorf("failure within window: delay = %v, want 2s", got)
+	}
+	now = now.Add(l.window + time.Second)
+	if got := l.failed("192.0.2.1", "alice"); got != time.Second {
+		t.Errorf("failure after window: delay = %v, want 1s", got)
+	}
+}
+
+func TestLoginLimiterLockout(t *testing.T) {
+	now := time.Date(2019, 10, 14, 10, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+
+	// Guesses from different IPs lock out the username.
+	for i := 0; i < l.maxUserFailures; i++ {
+		l.failed("192.0.2.1", "alice")
+		l.failed("192.0.2.2", "alice")
+	}
+	if !l.isLocked("192.0.2.1", "alice") {
+		t.Error("username not locked for IP with failures")
+	}
+	if l.isLocked("198.51.100.1", "alice") {
+		t.Error("username locked for IP without failures")
+	}
+	if l.isLocked("192.0.2.1", "bob") {
+		t.Error("other username locked")
+	}
+
+	// The IP is locked out for all usernames.
+	for i := 0; i < l.maxIPFailures; i++ {
+		l.failed("203.0.113.1", "bob")
+	}
+	if !l.isLocked("203.0.113.1", "carol") {
+		t.Error("IP not locked")
+	}
+
+	now = now.Add(l.lockout + time.Second)
+	if l.isLocked("192.0.2.1", "alice") || l.isLocked("203.0.113.1", "carol") {
+		t.Error("still locked after lockout")
+	}
+}
+
+func TestLoginLimiterSweep(t *testing.T) {
+	now := time.Date(2019, 10, 14, 10, 0, 0, 0, time.UTC)
+	l := newTestLoginLimiter(&now)
+	l.lockout = 2 * l.window
+
+	l.failed("192.0.2.1", "alice")
+	for i := 0; i < l.maxIPFailures; i++ {
+		l.failed("203.0.113.1", "bob")
+	}
+
+	// Expired failures are removed, locked out ones are kept.
+	now = now.Add(l.window + time.Minute)
+	l.sweep(now)
+	if _, ok := l.ips["192.0.2.1"]; ok {
+		t.Error("expired IP failures not removed")
+	}
+	if _, ok := l.users["alice"]; ok {
+		t.Error("expired username failures not removed")
+	}
+	if _, ok := l.ips["203.0.113.1"]; !ok {
+		t.Error("locked out IP removed")
+	}
+
+	now = now.Add(l.lockout)
+	l.sweep(now)
+	if len(l.ips) != 0 || len(l.users) != 0 {
+		t.Errorf("failures left after lockout: %d IPs, %d usernames", len(l.ips), len(l.users))
+	}
+}
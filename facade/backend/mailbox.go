@@ -1,9 +1,11 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,6 +19,21 @@ import (
 
 var Delimiter = "/"
 
+var errReadOnlyMailbox = errors.New("Mailbox is read-only")
+
+// Escape the hierarchy delimiter and LIST wildcards in names from OpenProject.
+var mailboxNameEscaper = strings.NewReplacer(
+	"%", "%25",
+	"*", "%2A",
+	Delimiter, "%2F",
+)
+
+// escapeMailboxName makes a project or status name safe to use as one level
+// of a mailbox name.
+func escapeMailboxName(name string) string {
+	return mailboxNameEscaper.Replace(name)
+}
+
 type Mailbox struct {
 	sync.RWMutex
 
@@ -37,10 +54,29 @@ type Mailbox struct {
 
 	// OpenProject Fields
 	ProjectID int `json:",omitempty"`
+	// Status of the work packages in a project's status folder.
+	StatusName string `json:",omitempty"`
+	// Work package field of a virtual mailbox.  The mailbox has the work
+	// packages where the field is the user, e.g. "assignee".
+	Filter string `json:",omitempty"`
+	// Saved query of a virtual mailbox.
+	QueryID int `json:",omitempty"`
+	// Project is archived or not accessible anymore.
+	Archived bool `json:",omitempty"`
+	// Newest work package 'updatedAt' seen.  Used for incremental syncs.
+	LastUpdatedAt time.Time
+	// Last time all work packages were requested.
+	LastFullSync time.Time
 
 	project *hal.Project
+	// Project mailbox of a status folder.
+	parent *Mailbox
+	// Status folders of a project mailbox.
+	statusMailboxes map[string]*Mailbox
 	// Map WorkPackage ID to message
 	workMap map[int]*Message
+	// Map Activity ID to comment message
+	activityMap map[int]*Message
 }
 
 func NewMailbox(user *User, name string, specialUse string) *Mailbox {
@@ -63,16 +99,43 @@ func NewMailbox(user *User, name string, specialUse string) *Mailbox {
 	return mbox
 }
 
-func NewProjectMailbox(user *User, project *hal.Project) *Mailbox {
-	mbox := NewMailbox(user, project.Name(), "")
+func NewProjectMailbox(user *User, name string, project *hal.Project) *Mailbox {
+	mbox := NewMailbox(user, name, "")
 	mbox.project = project
 	mbox.ProjectID = project.Id()
 	return mbox
 }
 
+func NewStatusMailbox(user *User, parent *Mailbox, status string) *Mailbox {
+	mbox := NewMailbox(user, parent.Name()+Delimiter+escapeMailboxName(status), "")
+	mbox.ProjectID = parent.ProjectID
+	mbox.StatusName = status
+	return mbox
+}
+
+func NewVirtualMailbox(user *User, name string, filter string) *Mailbox {
+	mbox := NewMailbox(user, name, "")
+	mbox.Filter = filter
+	return mbox
+}
+
+func NewQueryMailbox(user *User, name string, query *hal.Query) *Mailbox {
+	mbox := NewMailbox(user, name, "")
+	mbox.QueryID = query.Id()
+	return mbox
+}
+
+// isVirtual checks if the mailbox's messages come from an OpenProject filter
+// or saved query.  Virtual mailboxes are read-only, except for flags.
+func (mbox *Mailbox) isVirtual() bool {
+	return mbox.Filter != "" || mbox.QueryID > 0
+}
+
 func (mbox *Mailbox) init() {
 	mbox.msgs = []*Message{}
+	mbox.statusMailboxes = make(map[string]*Mailbox)
 	mbox.workMap = make(map[int]*Message)
+	mbox.activityMap = make(map[int]*Message)
 
 	// Initialize mailbox storage
 	if err := mbox.store.Init(&Message{}); err != nil {
@@ -85,54 +148,380 @@ func (mbox *Mailbox) init() {
 	}
 	for _, msg := range mbox.msgs {
 		msg.mbox = mbox
-		id := msg.WorkPackageID
-		if id > 0 {
-			mbox.workMap[id] = msg
-		}
+		mbox.mapMessage(msg)
+	}
+
+}
+
+// mapMessage adds a work package or comment message to the lookup maps.
+func (mbox *Mailbox) mapMessage(msg *Message) {
+	if msg.ActivityID > 0 {
+		mbox.activityMap[msg.ActivityID] = msg
+	} else if id := msg.WorkPackageID; id > 0 {
+		mbox.workMap[id] = msg
+	}
+}
+
+// lookupMessage finds the work package or comment message with the key.
+func (mbox *Mailbox) lookupMessage(key messageKey) *Message {
+	if key.ActivityID > 0 {
+		return mbox.activityMap[key.ActivityID]
 	}
+	return mbox.workMap[key.WorkPackageID]
+}
+
+func (mbox *Mailbox) hasWorkPackage(id int) bool {
+	mbox.RLock()
+	defer mbox.RUnlock()
 
+	_, ok := mbox.workMap[id]
+	return ok
 }
 
-func (mbox *Mailbox) checkWorkPackage(w *hal.WorkPackage) bool {
+// checkWorkPackage returns the current message for the work package and
+// if the message needs to be (re-)generated.
+func (mbox *Mailbox) checkWorkPackage(w *hal.WorkPackage) (*Message, bool) {
 	mbox.RLock()
 	defer mbox.RUnlock()
 
 	id := w.Id()
 	// Check for existing message.
-	if _, ok := mbox.workMap[id]; ok {
-		// TODO: check if work package has changed.
-		return false
+	msg, ok := mbox.workMap[id]
+	if !ok {
+		return nil, true
 	}
-	return true
+	// Check if work package has changed.
+	if updatedAt := w.GetUpdatedAt(); updatedAt != nil {
+		if !updatedAt.Equal(msg.UpdatedAt) {
+			return msg, true
+		}
+	}
+	return msg, false
 }
 
 func (mbox *Mailbox) workPackageToMessage(c *hal.HalClient, w *hal.WorkPackage) error {
 	id := w.Id()
 	// Check if work package needs to be created/updated
-	if !mbox.checkWorkPackage(w) {
+	old, changed := mbox.checkWorkPackage(w)
+	if !changed {
 		return nil
 	}
 
-	fmt.Printf("-- Create message for Work Package: %s\n", w.Subject())
+	if old == nil {
+		fmt.Printf("-- Create message for Work Package: %s\n", w.Subject())
+	} else {
+		fmt.Printf("-- Update message for Work Package: %s\n", w.Subject())
+	}
 
-	msg, err := mbox.user.GenerateMessage(w)
+	activities := mbox.user.LoadActivities(w)
+	msg, err := mbox.user.GenerateMessage(w, activities)
 	if err != nil {
 		return err
 	}
 
 	// Modify mailbox.  Append new message.
 	mbox.Lock()
-	defer mbox.Unlock()
-	// Add message to mailbox
-	mbox.appendMessage(msg)
+	if old != nil {
+		// Keep the flags of the old message, except for flags mapped to
+		// work package fields.
+		msg.Flags = applyFieldFlags(old.Flags, w)
+		// Replace old message
+		mbox.replaceMessage(old, msg)
+	} else {
+		// Add message to mailbox
+		mbox.appendMessage(msg)
+		mbox.user.PushMailboxUpdate(mbox)
+	}
 
 	// map work package to message
 	mbox.workMap[id] = msg
+	mbox.Unlock()
+
+	// Add messages for new comments
+	mbox.syncComments(w, activities)
 
 	return nil
 }
 
-func (mbox *Mailbox) createWorkPackages(c *hal.HalClient, col *hal.Collection) error {
+// syncComments appends a message for each work package comment that doesn't
+// have one yet.  Messages of edited comments are replaced.
+func (mbox *Mailbox) syncComments(w *hal.WorkPackage, activities []*Activity) {
+	for _, act := range activities {
+		if !act.HasComment() {
+			continue
+		}
+		mbox.RLock()
+		old, ok := mbox.activityMap[act.Id]
+		mbox.RUnlock()
+		if ok && !commentChanged(old, act) {
+			continue
+		}
+
+		msg, err := mbox.user.GenerateComment(w, act)
+		if err != nil {
+			log.Printf("--- Failed to create message from comment: %d", act.Id)
+			continue
+		}
+
+		mbox.Lock()
+		if old != nil {
+			fmt.Printf("-- Update message for comment: %d\n", act.Id)
+			msg.Flags = old.Flags
+			mbox.replaceMessage(old, msg)
+		} else {
+			mbox.appendMessage(msg)
+			mbox.user.PushMailboxUpdate(mbox)
+		}
+		mbox.activityMap[act.Id] = msg
+		mbox.Unlock()
+	}
+}
+
+// commentChanged checks if the comment was edited since the message was
+// generated.
+func commentChanged(msg *Message, act *Activity) bool {
+	if msg.UpdatedAt.IsZero() {
+		// Message from before edits were tracked.  Only changed if the
+		// comment was edited.
+		return !act.UpdatedAt.Equal(act.Date)
+	}
+	return !msg.UpdatedAt.Equal(act.UpdatedAt)
+}
+
+// projectMailbox returns the project mailbox of a status folder.
+func (mbox *Mailbox) projectMailbox() *Mailbox {
+	if mbox.parent != nil {
+		return mbox.parent
+	}
+	return mbox
+}
+
+// statusMailbox returns the status folder for the work package's status.
+// Returns the project mailbox if there is no folder for the status.
+func (mbox *Mailbox) statusMailbox(w *hal.WorkPackage) *Mailbox {
+	if status := w.GetLink("status"); status != nil {
+		if child, ok := mbox.statusMailboxes[status.Title]; ok {
+			return child
+		}
+	}
+	return mbox
+}
+
+// syncWorkPackage updates the work package's message in the project mailbox
+// or in the status folder of the work package's status.  Messages are moved
+// between the folders when the status changes, and from the old project's
+// mailbox when the work package was moved to this project.
+func (mbox *Mailbox) syncWorkPackage(c *hal.HalClient, w *hal.WorkPackage) error {
+	if mbox.parent != nil {
+		return mbox.parent.syncWorkPackage(c, w)
+	}
+	if mbox.ProjectID == 0 {
+		// Virtual mailboxes don't have status folders.
+		return mbox.workPackageToMessage(c, w)
+	}
+
+	id := w.Id()
+	target := mbox.statusMailbox(w)
+	// Follow work packages moved from another project.
+	if old := mbox.user.lookupWorkPackage(id); old != nil && old.projectMailbox() != mbox {
+		log.Printf("--- Move work package %d from '%s' to '%s'", id, old.Name(), target.Name())
+		old.moveWorkPackage(id, target)
+	}
+	if target != mbox && mbox.hasWorkPackage(id) {
+		mbox.moveWorkPackage(id, target)
+	}
+	for _, child := range mbox.statusMailboxes {
+		if target != child && child.hasWorkPackage(id) {
+			child.moveWorkPackage(id, target)
+		}
+	}
+	if err := target.workPackageToMessage(c, w); err != nil {
+		return err
+	}
+	mbox.user.indexWorkPackage(id, target)
+	return nil
+}
+
+// takeWorkPackage removes the messages of a work package from the mailbox.
+// Returns copies of the removed messages.
+func (mbox *Mailbox) takeWorkPackage(id int) []*Message {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	var taken []*Message
+	for i := len(mbox.msgs) - 1; i >= 0; i-- {
+		msg := mbox.msgs[i]
+		if msg.WorkPackageID != id {
+			continue
+		}
+		taken = append([]*Message{msg.copy()}, taken...)
+		mbox.removeMessage(msg)
+	}
+	return taken
+}
+
+// putWorkPackage adds the messages of a work package to the mailbox.
+func (mbox *Mailbox) putWorkPackage(msgs []*Message) {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	for _, msg := range msgs {
+		// Get a new UID in this mailbox.
+		msg.Uid = 0
+		mbox.appendMessage(msg)
+		mbox.mapMessage(msg)
+	}
+	mbox.saveMailbox()
+	mbox.user.PushMailboxUpdate(mbox)
+}
+
+// workPackageIDs returns the ids of the mailbox's work packages.
+func (mbox *Mailbox) workPackageIDs() []int {
+	mbox.RLock()
+	defer mbox.RUnlock()
+
+	ids := make([]int, 0, len(mbox.workMap))
+	for id := range mbox.workMap {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// removeWorkPackage expunges the messages of a work package.
+func (mbox *Mailbox) removeWorkPackage(id int) {
+	mbox.user.unindexWorkPackage(id, mbox)
+
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	for i := len(mbox.msgs) - 1; i >= 0; i-- {
+		if msg := mbox.msgs[i]; msg.WorkPackageID == id {
+			mbox.removeMessage(msg)
+		}
+	}
+}
+
+// checkStaleWorkPackage checks if the work package was deleted, moved to
+// another project or isn't accessible anymore.  Returns the work package if
+// it was moved.
+func (mbox *Mailbox) checkStaleWorkPackage(c *hal.HalClient, id int) (*hal.WorkPackage, bool) {
+	res, err := c.Get(workPackageURL(id))
+	if err != nil {
+		// Only "not found" and "permission denied" mean that the work package
+		// is gone.  Network and server errors or rate limits don't.
+		if resErr, ok := err.(*hal.Error); ok {
+			switch resErr.ErrorIdentifier() {
+			case "urn:openproject-org:api:v3:errors:NotFound",
+				"urn:openproject-org:api:v3:errors:MissingPermission":
+				return nil, true
+			}
+		}
+		return nil, false
+	}
+	w, ok := res.(*hal.WorkPackage)
+	if !ok {
+		return nil, false
+	}
+	if linkID(w.GetLink("project")) == mbox.ProjectID {
+		return nil, false
+	}
+	return w, true
+}
+
+// removeStaleWorkPackages expunges the messages of work packages that weren't
+// returned by a full sync of the project, if they are stale.  Work packages
+// moved to another project are moved to that project's mailbox.
+func (mbox *Mailbox) removeStaleWorkPackages(c *hal.HalClient, seen map[int]bool) {
+	mboxes := []*Mailbox{mbox}
+	for _, child := range mbox.statusMailboxes {
+		mboxes = append(mboxes, child)
+	}
+	for _, m := range mboxes {
+		for _, id := range m.workPackageIDs() {
+			if seen[id] {
+				continue
+			}
+			w, stale := mbox.checkStaleWorkPackage(c, id)
+			if !stale {
+				continue
+			}
+			if w != nil {
+				dest := mbox.user.lookupProject(linkID(w.GetLink("project")))
+				if dest != nil {
+					if err := dest.syncWorkPackage(c, w); err == nil {
+						continue
+					}
+				}
+			}
+			log.Printf("--- Remove messages of stale work package: %d", id)
+			m.removeWorkPackage(id)
+		}
+	}
+}
+
+// moveWorkPackage moves the messages of a work package to another mailbox.
+// The flags of the messages are kept.
+func (mbox *Mailbox) moveWorkPackage(id int, dest *Mailbox) {
+	if msgs := mbox.takeWorkPackage(id); len(msgs) > 0 {
+		dest.putWorkPackage(msgs)
+		mbox.user.indexWorkPackage(id, dest)
+	}
+}
+
+// syncProgress tracks the work packages of a sync.
+type syncProgress struct {
+	// Ids of the work packages returned by OpenProject.
+	seen map[int]bool
+	// Newest 'updatedAt' of the synced work packages.
+	newest time.Time
+	// Oldest 'updatedAt' of the work packages that failed to sync.
+	oldestFailed time.Time
+	// A work package without 'updatedAt' failed to sync.
+	failedUnknown bool
+}
+
+func newSyncProgress() *syncProgress {
+	return &syncProgress{
+		seen: make(map[int]bool),
+	}
+}
+
+func (p *syncProgress) synced(w *hal.WorkPackage) {
+	if updatedAt := w.GetUpdatedAt(); updatedAt != nil && updatedAt.After(p.newest) {
+		p.newest = *updatedAt
+	}
+}
+
+func (p *syncProgress) failed(w *hal.WorkPackage) {
+	updatedAt := w.GetUpdatedAt()
+	if updatedAt == nil {
+		p.failedUnknown = true
+		return
+	}
+	if p.oldestFailed.IsZero() || updatedAt.Before(p.oldestFailed) {
+		p.oldestFailed = *updatedAt
+	}
+}
+
+// highWaterMark returns the 'updatedAt' for the next incremental sync.  The
+// mark doesn't pass work packages that failed to sync, so they are requested
+// again.
+func (p *syncProgress) highWaterMark(current time.Time) time.Time {
+	if p.failedUnknown {
+		return current
+	}
+	mark := current
+	if p.newest.After(mark) {
+		mark = p.newest
+	}
+	if !p.oldestFailed.IsZero() && p.oldestFailed.Before(mark) {
+		mark = p.oldestFailed
+	}
+	return mark
+}
+
+// createWorkPackages creates/updates messages for all pages of work packages.
+func (mbox *Mailbox) createWorkPackages(c *hal.HalClient, col *hal.Collection, progress *syncProgress) error {
 	log.Printf("-- Load work packages from page: %d", col.Offset())
 	for _, itemRes := range col.Items() {
 		work, ok := itemRes.(*hal.WorkPackage)
@@ -140,16 +529,22 @@ func (mbox *Mailbox) createWorkPackages(c *hal.HalClient, col *hal.Collection) e
 			log.Printf("Invalid resource type: %s", itemRes.ResourceType())
 			continue
 		}
-		if err := mbox.workPackageToMessage(c, work); err != nil {
+		progress.seen[work.Id()] = true
+		if err := mbox.syncWorkPackage(c, work); err != nil {
 			log.Printf("--- Failed to create message from work package: %s", work.Subject())
+			progress.failed(work)
+			continue
 		}
+		progress.synced(work)
 	}
 
 	// Check for next page.
 	if col.IsPaginated() {
-		if nextCol, err := col.NextPage(c); err == nil {
-			return mbox.createWorkPackages(c, nextCol)
+		nextCol, err := col.NextPage(c)
+		if err != nil {
+			return err
 		}
+		return mbox.createWorkPackages(c, nextCol, progress)
 	}
 	return nil
 }
@@ -161,19 +556,120 @@ func (mbox *Mailbox) runUpdate(c *hal.HalClient) {
 	}
 }
 
+// needFullSync checks if all work packages should be requested, instead of
+// only the work packages updated since the last sync.
+func (mbox *Mailbox) needFullSync() bool {
+	mbox.RLock()
+	defer mbox.RUnlock()
+
+	if mbox.LastUpdatedAt.IsZero() {
+		return true
+	}
+	interval := time.Second * time.Duration(mbox.user.backend.fullSyncInterval)
+	return time.Since(mbox.LastFullSync) >= interval
+}
+
+func (mbox *Mailbox) getUpdatedWorkPackages(c *hal.HalClient) (*hal.Collection, error) {
+	mbox.RLock()
+	since := mbox.LastUpdatedAt.UTC().Format(time.RFC3339)
+	mbox.RUnlock()
+
+	// Include closed work packages, see getAllWorkPackages.
+	url := fmt.Sprintf("/api/v3/projects/%d/work_packages", mbox.ProjectID)
+	f := hal.NewFilters().Filter("updatedAt", "<>d", since, "").
+		Filter("status", "*", []interface{}{}...)
+	return c.GetFilteredCollection(url, f)
+}
+
+// getAllWorkPackages requests all work packages of the project for a full
+// sync.  Without a status filter OpenProject only returns open work packages.
+func (mbox *Mailbox) getAllWorkPackages(c *hal.HalClient) (*hal.Collection, error) {
+	url := fmt.Sprintf("/api/v3/projects/%d/work_packages", mbox.ProjectID)
+	// The "all" operator needs an empty list of values.
+	f := hal.NewFilters().Filter("status", "*", []interface{}{}...)
+	return c.GetFilteredCollection(url, f)
+}
+
+// getVirtualWorkPackages requests the work packages of the virtual mailbox's
+// filter or saved query.
+func (mbox *Mailbox) getVirtualWorkPackages(c *hal.HalClient) (*hal.Collection, error) {
+	if mbox.QueryID > 0 {
+		res, err := c.Get(queryURL(mbox.QueryID))
+		if err != nil {
+			return nil, err
+		}
+		query, ok := res.(*hal.Query)
+		if !ok {
+			return nil, fmt.Errorf("Expected a Query resource: %+v", res)
+		}
+		return query.GetResults(c)
+	}
+	f := hal.NewFilters().Filter(mbox.Filter, "=", "me")
+	return c.GetFilteredCollection("/api/v3/work_packages", f)
+}
+
+// updateVirtualWorkPackages requests all work packages of the virtual
+// mailbox.  Messages of work packages that no longer match are expunged.
+func (mbox *Mailbox) updateVirtualWorkPackages(c *hal.HalClient) error {
+	col, err := mbox.getVirtualWorkPackages(c)
+	if err != nil {
+		return err
+	}
+	progress := newSyncProgress()
+	if err := mbox.createWorkPackages(c, col, progress); err != nil {
+		return err
+	}
+
+	mbox.Lock()
+	defer mbox.Unlock()
+	for i := len(mbox.msgs) - 1; i >= 0; i-- {
+		msg := mbox.msgs[i]
+		if msg.WorkPackageID > 0 && !progress.seen[msg.WorkPackageID] {
+			mbox.removeMessage(msg)
+		}
+	}
+	return nil
+}
+
 func (mbox *Mailbox) updateWorkPackages(c *hal.HalClient) error {
-	if mbox.project == nil {
-		// Not a project folder.
+	if mbox.isVirtual() {
+		return mbox.updateVirtualWorkPackages(c)
+	}
+	if mbox.project == nil || mbox.parent != nil {
+		// Not a project folder.  Status folders are updated by the project.
 		return nil
 	}
-	// Get work package
-	col, err := mbox.project.GetWorkPackages(c)
+	fullSync := mbox.needFullSync()
+	syncStarted := time.Now()
+
+	// Get work packages
+	var col *hal.Collection
+	var err error
+	if fullSync {
+		col, err = mbox.getAllWorkPackages(c)
+	} else {
+		col, err = mbox.getUpdatedWorkPackages(c)
+	}
 	if err != nil {
 		return err
 	}
-	if err := mbox.createWorkPackages(c, col); err != nil {
+	progress := newSyncProgress()
+	if err := mbox.createWorkPackages(c, col, progress); err != nil {
 		return err
 	}
+	if fullSync {
+		mbox.removeStaleWorkPackages(c, progress.seen)
+	}
+
+	// Save sync state.  Only advanced after all pages were synced.
+	mbox.Lock()
+	mbox.LastUpdatedAt = progress.highWaterMark(mbox.LastUpdatedAt)
+	if fullSync {
+		mbox.LastFullSync = syncStarted
+	}
+	mbox.saveMailbox()
+	mbox.Unlock()
+
 	log.Printf("------------- Finished loading work packages.")
 	return nil
 }
@@ -183,11 +679,21 @@ func (mbox *Mailbox) Name() string {
 }
 
 func (mbox *Mailbox) Info() (*imap.MailboxInfo, error) {
+	// Check for child mailboxes before locking this mailbox.
+	children := imap.HasNoChildrenAttr
+	if mbox.user.hasChildren(mbox.Name()) {
+		children = imap.HasChildrenAttr
+	}
+
 	mbox.RLock()
 	defer mbox.RUnlock()
 
+	attrs := make([]string, 0, len(mbox.Attributes)+1)
+	attrs = append(attrs, mbox.Attributes...)
+	attrs = append(attrs, children)
+
 	info := &imap.MailboxInfo{
-		Attributes: mbox.Attributes,
+		Attributes: attrs,
 		Delimiter:  Delimiter,
 		Name:       mbox.MailboxName,
 	}
@@ -359,6 +865,17 @@ func (mbox *Mailbox) deleteMessage(msg *Message) {
 	if err := mbox.store.DeleteStruct(msg); err != nil {
 		log.Println("Error deleting message in mailbox:", err)
 	}
+
+	// Remove work package mapping
+	if msg.ActivityID > 0 {
+		if mbox.activityMap[msg.ActivityID] == msg {
+			delete(mbox.activityMap, msg.ActivityID)
+		}
+	} else if msg.WorkPackageID > 0 {
+		if mbox.workMap[msg.WorkPackageID] == msg {
+			delete(mbox.workMap, msg.WorkPackageID)
+		}
+	}
 }
 
 func (mbox *Mailbox) appendMessage(msg *Message) {
@@ -379,19 +896,98 @@ func (mbox *Mailbox) appendMessage(msg *Message) {
 	mbox.msgs = append(mbox.msgs, msg)
 }
 
-func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	mbox.Lock()
-	defer mbox.Unlock()
+// removeMessage deletes the message from the mailbox and notifies clients.
+func (mbox *Mailbox) removeMessage(msg *Message) bool {
+	for i, cur := range mbox.msgs {
+		if cur == msg {
+			mbox.deleteMessage(msg)
+			mbox.msgs = append(mbox.msgs[:i], mbox.msgs[i+1:]...)
+			// send expunge update
+			mbox.user.PushExpungeUpdate(mbox.MailboxName, uint32(i+1))
+			return true
+		}
+	}
+	return false
+}
 
-	if date.IsZero() {
-		date = time.Now()
+// replaceMessage expunges the old message and appends the new message, which
+// gets a new UID.  Clients are notified of both changes.
+func (mbox *Mailbox) replaceMessage(old *Message, msg *Message) {
+	mbox.removeMessage(old)
+
+	mbox.appendMessage(msg)
+	mbox.user.PushMailboxUpdate(mbox)
+}
+
+// createWorkPackageFromMessage creates a work package in the mailbox's
+// project.  The message is replaced by the message generated from the new
+// work package.
+func (mbox *Mailbox) createWorkPackageFromMessage(b []byte, flags []string) error {
+	project := mbox.projectMailbox()
+	if project.project == nil {
+		return errors.New("Project not loaded")
+	}
+	nw, err := parseNewWorkPackage(b)
+	if err != nil {
+		return err
+	}
+
+	u := mbox.user
+	log.Printf("--- Create work package: %s", nw.Subject)
+	w, err := u.createWorkPackage(project.project, nw)
+	if err != nil {
+		log.Printf("Failed to create work package: %v", err)
+		return err
+	}
+	// Work packages added to a status folder get the folder's status.
+	if mbox.StatusName != "" {
+		if _, err := u.setWorkPackageStatus(w.Id(), mbox.StatusName); err != nil {
+			log.Printf("Failed to set status of work package: %v", err)
+		}
+	}
+	// Reload work package to get the uploaded attachments.
+	if cur, err := u.getWorkPackage(w.Id()); err == nil {
+		w = cur
+	}
+
+	if err := mbox.syncWorkPackage(u.hal, w); err != nil {
+		return err
 	}
 
+	// Set flags from the APPEND command
+	target := project.statusMailbox(w)
+	target.RLock()
+	msg, ok := target.workMap[w.Id()]
+	target.RUnlock()
+	if ok && len(flags) > 0 {
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(msg.Uid)
+		return target.UpdateMessagesFlags(true, seqset, imap.AddFlags, flags)
+	}
+	return nil
+}
+
+func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
 	b, err := ioutil.ReadAll(body)
 	if err != nil {
 		return err
 	}
 
+	if mbox.isVirtual() {
+		return errReadOnlyMailbox
+	}
+	if mbox.ProjectID > 0 {
+		// Messages added to project mailboxes become new work packages.
+		return mbox.createWorkPackageFromMessage(b, flags)
+	}
+
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	if date.IsZero() {
+		date = time.Now()
+	}
+
 	mbox.appendMessage(&Message{
 		Date:  date,
 		Size:  uint32(len(b)),
@@ -404,17 +1000,28 @@ func (mbox *Mailbox) CreateMessage(flags []string, date time.Time, body imap.Lit
 	return nil
 }
 
-func (mbox *Mailbox) pushMessageUpdate(uid bool, msg *Message, seqNum uint32) {
-	// Update message
-	if err := mbox.store.Update(msg); err != nil {
-		log.Println("Error updating message in mailbox:", err)
-	}
-
+// pushMessageUpdate saves the message's flags in OpenProject and notifies
+// clients.  changed are the added and removed flags.
+func (mbox *Mailbox) pushMessageUpdate(uid bool, msg *Message, seqNum uint32, changed []string) {
 	// If message is for a work package, then update flags in OpenProject
-	if msg.WorkPackageID > 0 {
+	if msg.WorkPackageID > 0 && msg.ActivityID == 0 {
 		if err := mbox.user.updateWorkPackageFlags(msg); err != nil {
 			log.Println("Error updating work package flags:", err)
 		}
+		if err := mbox.user.updateWorkPackageFields(msg, changed); err != nil {
+			log.Println("Error updating work package fields:", err)
+		}
+	}
+
+	mbox.pushFlagsUpdate(uid, msg, seqNum)
+}
+
+// pushFlagsUpdate saves the message's flags and notifies clients, without
+// updating the flags in OpenProject.
+func (mbox *Mailbox) pushFlagsUpdate(uid bool, msg *Message, seqNum uint32) {
+	// Update message
+	if err := mbox.store.Update(msg); err != nil {
+		log.Println("Error updating message in mailbox:", err)
 	}
 
 	items := []imap.FetchItem{imap.FetchFlags}
@@ -447,9 +1054,27 @@ func UpdateFlags(current []string, op imap.FlagsOp, flags []string) ([]string, b
 }
 
 func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	changed, updated := mbox.updateMessagesFlags(uid, seqset, op, flags)
+
+	// Update the copies of the messages in other mailboxes.
+	if len(changed) > 0 {
+		mbox.user.shareFlags(mbox, changed)
+	}
+	if len(updated) > 0 {
+		mbox.user.shareUpdatedAt(updated)
+	}
+	return nil
+}
+
+// updateMessagesFlags returns the new flags of the changed work package
+// messages, and the new 'updatedAt' of work packages changed by storing the
+// flags.
+func (mbox *Mailbox) updateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) (map[messageKey][]string, map[int]time.Time) {
 	mbox.Lock()
 	defer mbox.Unlock()
 
+	changed := make(map[messageKey][]string)
+	updated := make(map[int]time.Time)
 	for i, msg := range mbox.msgs {
 		var id uint32
 		if uid {
@@ -461,33 +1086,86 @@ func (mbox *Mailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.
 			continue
 		}
 
-		if newFlags, changed := UpdateFlags(msg.Flags, op, flags); changed {
+		oldFlags := append(msg.Flags[:0:0], msg.Flags...)
+		if newFlags, ok := UpdateFlags(msg.Flags, op, flags); ok {
 			msg.Flags = newFlags
-			mbox.pushMessageUpdate(uid, msg, uint32(i+1))
+			updatedAt := msg.UpdatedAt
+			mbox.pushMessageUpdate(uid, msg, uint32(i+1), changedFlags(oldFlags, newFlags))
+			if msg.WorkPackageID > 0 {
+				changed[msg.key()] = sharedFlags(newFlags)
+			}
+			if !msg.UpdatedAt.Equal(updatedAt) {
+				updated[msg.WorkPackageID] = msg.UpdatedAt
+			}
 		}
 	}
 
 	// Update mailbox flags list
 	if op == imap.AddFlags || op == imap.SetFlags {
-		if newFlags, changed := UpdateFlags(mbox.Flags, imap.AddFlags, flags); changed {
+		if newFlags, ok := UpdateFlags(mbox.Flags, imap.AddFlags, flags); ok {
 			mbox.Flags = newFlags
 			mbox.saveMailbox()
 			mbox.user.PushMailboxUpdate(mbox)
 		}
 	}
 
-	return nil
+	return changed, updated
 }
 
-// TODO: CopyMessages must also lock destination mailbox.
-func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+// setSharedFlags sets the flags of the copies of changed messages.
+func (mbox *Mailbox) setSharedFlags(changed map[messageKey][]string) {
 	mbox.Lock()
 	defer mbox.Unlock()
 
+	for i, msg := range mbox.msgs {
+		if msg.WorkPackageID == 0 {
+			continue
+		}
+		flags, ok := changed[msg.key()]
+		if !ok {
+			continue
+		}
+		if flags = mergeSharedFlags(msg.Flags, flags); CompareFlags(flags, msg.Flags) {
+			continue
+		}
+		msg.Flags = flags
+		mbox.pushFlagsUpdate(true, msg, uint32(i+1))
+	}
+}
+
+// setUpdatedAt sets the 'updatedAt' of work package messages, after the
+// facade changed the work packages.
+func (mbox *Mailbox) setUpdatedAt(updated map[int]time.Time) {
+	mbox.Lock()
+	defer mbox.Unlock()
+
+	for _, msg := range mbox.msgs {
+		updatedAt, ok := updated[msg.WorkPackageID]
+		if !ok || msg.ActivityID > 0 || msg.UpdatedAt.Equal(updatedAt) {
+			continue
+		}
+		msg.UpdatedAt = updatedAt
+		if err := mbox.store.Update(msg); err != nil {
+			log.Println("Error updating message in mailbox:", err)
+		}
+	}
+}
+
+// TODO: CopyMessages must also lock destination mailbox.
+func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
 	dest, ok := mbox.user.mailboxes[destName]
 	if !ok {
 		return backend.ErrNoSuchMailbox
 	}
+	if dest.isVirtual() {
+		return errReadOnlyMailbox
+	}
+	if dest.ProjectID > 0 {
+		return mbox.copyToProject(uid, seqset, dest, false)
+	}
+
+	mbox.Lock()
+	defer mbox.Unlock()
 
 	for i, msg := range mbox.msgs {
 		var id uint32
@@ -509,15 +1187,112 @@ func (mbox *Mailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string
 	return nil
 }
 
+// copyToProject copies or moves messages into a project mailbox or status
+// folder.  Work package messages (e.g. from INBOX) are moved to the folder of
+// their project mailbox and get the folder's status.  Other messages become
+// new work packages.
+func (mbox *Mailbox) copyToProject(uid bool, seqset *imap.SeqSet, dest *Mailbox, move bool) error {
+	// Find work packages and new messages.
+	var ids []int
+	var newMsgs []*Message
+	var newFlags [][]string
+	mbox.RLock()
+	for i, msg := range mbox.msgs {
+		var id uint32
+		if uid {
+			id = msg.Uid
+		} else {
+			id = uint32(i + 1)
+		}
+		if !seqset.Contains(id) {
+			continue
+		}
+		if msg.WorkPackageID == 0 {
+			newMsgs = append(newMsgs, msg)
+			flags := append(msg.Flags[:0:0], msg.Flags...)
+			newFlags = append(newFlags, backendutil.UpdateFlags(flags, imap.RemoveFlags,
+				[]string{imap.RecentFlag, imap.DeletedFlag}))
+		} else if msg.ActivityID == 0 {
+			ids = append(ids, msg.WorkPackageID)
+		}
+	}
+	mbox.RUnlock()
+
+	var lastErr error
+	for _, id := range ids {
+		if err := mbox.user.moveWorkPackageStatus(id, dest); err != nil {
+			log.Printf("Failed to move work package %d to '%s': %v", id, dest.Name(), err)
+			lastErr = err
+		}
+	}
+
+	var created []*Message
+	for i, msg := range newMsgs {
+		if err := dest.createWorkPackageFromMessage(msg.getBody(), newFlags[i]); err != nil {
+			lastErr = err
+			continue
+		}
+		created = append(created, msg)
+	}
+
+	if move && len(created) > 0 {
+		// Remove the messages that became work packages.  Other messages
+		// flagged \Deleted aren't expunged.
+		mbox.Lock()
+		for _, msg := range created {
+			mbox.removeMessage(msg)
+		}
+		mbox.Unlock()
+	}
+	return lastErr
+}
+
+// moveWorkPackageStatus moves the work package's messages to a folder of its
+// project mailbox, and changes the work package's status to the folder's
+// status.
+func (u *User) moveWorkPackageStatus(id int, dest *Mailbox) error {
+	cur := u.lookupWorkPackage(id)
+	if cur == nil || cur.projectMailbox() != dest.projectMailbox() {
+		return fmt.Errorf("Work package %d isn't in project mailbox '%s'", id, dest.projectMailbox().Name())
+	}
+	if cur == dest {
+		return nil
+	}
+
+	status := dest.StatusName
+	if status == "" {
+		status = defaultStatus
+	}
+	changedAt, err := u.setWorkPackageStatus(id, status)
+	if err != nil {
+		return err
+	}
+	cur.moveWorkPackage(id, dest)
+	// Keep the moved messages (and the INBOX copy) from being generated
+	// again.
+	if !changedAt.IsZero() {
+		u.shareUpdatedAt(map[int]time.Time{id: changedAt})
+	}
+	return nil
+}
+
 // TODO: MoveMessages must also lock destination mailbox.
 func (mbox *Mailbox) MoveMessages(uid bool, seqset *imap.SeqSet, destName string) error {
-	mbox.Lock()
-	defer mbox.Unlock()
-
 	dest, ok := mbox.user.mailboxes[destName]
 	if !ok {
 		return backend.ErrNoSuchMailbox
 	}
+	if mbox.isVirtual() || dest.isVirtual() {
+		return errReadOnlyMailbox
+	}
+	if dest.ProjectID > 0 {
+		// Work package messages stay in INBOX, which has a copy of every
+		// work package.
+		return mbox.copyToProject(uid, seqset, dest, true)
+	}
+
+	mbox.Lock()
+	defer mbox.Unlock()
 
 	flags := []string{imap.DeletedFlag}
 	for i, msg := range mbox.msgs {
@@ -568,6 +1343,10 @@ func (mbox *Mailbox) expunge() error {
 }
 
 func (mbox *Mailbox) Expunge() error {
+	if mbox.isVirtual() {
+		return errReadOnlyMailbox
+	}
+
 	mbox.Lock()
 	defer mbox.Unlock()
 
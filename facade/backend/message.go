@@ -3,6 +3,7 @@ package backend
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"log"
 	"math"
@@ -17,6 +18,21 @@ import (
 	"github.com/jordan-wright/email"
 )
 
+// Host part of generated Message-IDs.
+var messageIDHost = "localhost"
+
+func welcomeMessageID(username string) string {
+	return fmt.Sprintf("<welcome.%s@%s>", username, messageIDHost)
+}
+
+func workPackageMessageID(workID int) string {
+	return fmt.Sprintf("<work-package-%d@%s>", workID, messageIDHost)
+}
+
+func activityMessageID(workID, activityID int) string {
+	return fmt.Sprintf("<work-package-%d.activity-%d@%s>", workID, activityID, messageIDHost)
+}
+
 func WordCount(text string) int {
 	words := strings.Fields(text)
 	return len(words)
@@ -30,6 +46,13 @@ type Message struct {
 
 	// Work Package message fields
 	WorkPackageID int `json:",omitempty"`
+	// Work package (or comment) 'updatedAt' the message was generated from.
+	UpdatedAt time.Time
+	// Set for work package comment messages.
+	ActivityID int `json:",omitempty"`
+
+	// Message-ID header of the message.
+	MessageID string `json:",omitempty"`
 
 	// Word count for reading time estimate
 	WordCount int `json:",omitempty"`
@@ -49,6 +72,20 @@ func (m *Message) ReadingTime() time.Duration {
 	return ReadingTime(m.WordCount)
 }
 
+// messageKey identifies the copies of a work package or comment message in
+// different mailboxes.
+type messageKey struct {
+	WorkPackageID int
+	ActivityID    int
+}
+
+func (m *Message) key() messageKey {
+	return messageKey{
+		WorkPackageID: m.WorkPackageID,
+		ActivityID:    m.ActivityID,
+	}
+}
+
 func (m *Message) copy() *Message {
 	msgCopy := *m
 	msgCopy.body = m.getBody()
@@ -62,8 +99,9 @@ func (m *Message) getBody() []byte {
 	return m.body
 }
 
-func buildSimpleMessage(from, to, cc, subject, text, html string) (*Message, error) {
+func buildSimpleMessage(msgID, from, to, cc, subject, text, html string) (*Message, error) {
 	e := email.NewEmail()
+	e.Headers.Set("Message-ID", msgID)
 	e.From = from
 	if to != "" {
 		e.To = []string{to}
@@ -83,6 +121,7 @@ func buildSimpleMessage(from, to, cc, subject, text, html string) (*Message, err
 		Date:      time.Now(),
 		Flags:     []string{},
 		Size:      uint32(len(buf)),
+		MessageID: msgID,
 		body:      buf,
 		WordCount: WordCount(text),
 	}
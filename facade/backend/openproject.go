@@ -0,0 +1,171 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"time"
+
+	hal "github.com/lectio/go-json-hal"
+)
+
+var errReadOnlyUser = errors.New("OpenProject is read-only for this user")
+
+// writeBack runs a change to OpenProject and records it in the audit log.
+// In read-only mode the change is only logged.
+func (u *User) writeBack(entry *AuditEntry, change func() error) error {
+	entry.Time = time.Now()
+	entry.User = u.username
+
+	var err error
+	if u.readOnly {
+		log.Printf("--- Read-only: would %s (work package %d)", entry.Operation, entry.WorkPackageID)
+		entry.Result = "read-only"
+	} else if err = change(); err != nil {
+		entry.Result = err.Error()
+	} else {
+		entry.Result = "ok"
+	}
+	u.backend.audit(entry)
+	return err
+}
+
+// linkID returns the resource id from a link's url.  Returns 0 if the link
+// is empty or doesn't end with an id.
+func linkID(link *hal.Link) int {
+	if link == nil || link.Href == "" {
+		return 0
+	}
+	id, err := strconv.Atoi(path.Base(link.Href))
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+func workPackageURL(workID int) string {
+	return fmt.Sprintf("/api/v3/work_packages/%d", workID)
+}
+
+func (u *User) getWorkPackage(workID int) (*hal.WorkPackage, error) {
+	res, err := u.hal.Get(workPackageURL(workID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load work package: %d", workID)
+	}
+	w, ok := res.(*hal.WorkPackage)
+	if !ok {
+		return nil, fmt.Errorf("Expected a WorkPackage resource: %+v", res)
+	}
+	return w, nil
+}
+
+func (u *User) addWorkPackageComment(workID int, comment string) error {
+	w, err := u.getWorkPackage(workID)
+	if err != nil {
+		return err
+	}
+	entry := &AuditEntry{
+		WorkPackageID: workID,
+		Operation:     "add comment",
+		After:         comment,
+	}
+	return u.writeBack(entry, func() error {
+		_, err := w.AddComment(u.hal, comment)
+		return err
+	})
+}
+
+// workPackageUpdatedAt returns the 'updatedAt' of the work package returned
+// by an update.  The zero time if unknown.
+func workPackageUpdatedAt(res hal.Resource) time.Time {
+	if w, ok := res.(*hal.WorkPackage); ok {
+		if updatedAt := w.GetUpdatedAt(); updatedAt != nil {
+			return *updatedAt
+		}
+	}
+	return time.Time{}
+}
+
+// setWorkPackageStatus changes the status of the work package.  Returns the
+// work package's new 'updatedAt', or the zero time if it wasn't changed.
+func (u *User) setWorkPackageStatus(workID int, status string) (time.Time, error) {
+	var changedAt time.Time
+	link, err := u.backend.FindNamedResourceURL(u.hal, "/api/v3/statuses", status)
+	if err != nil {
+		return changedAt, err
+	}
+	w, err := u.getWorkPackage(workID)
+	if err != nil {
+		return changedAt, err
+	}
+	if cur := w.GetLink("status"); cur != nil && cur.Href == link.Href {
+		// Already has the status.
+		return changedAt, nil
+	}
+	log.Printf("--- Change status of work package %d to: %s", workID, status)
+	entry := &AuditEntry{
+		WorkPackageID: workID,
+		Operation:     "change status",
+		Before:        fieldValue(w, "status"),
+		After:         status,
+	}
+	err = u.writeBack(entry, func() error {
+		w.SetLink("status", link.Href)
+		res, err := w.Update(u.hal)
+		changedAt = workPackageUpdatedAt(res)
+		return err
+	})
+	return changedAt, err
+}
+
+// createWorkPackage creates a work package in the project and uploads its
+// attachments.
+func (u *User) createWorkPackage(proj *hal.Project, nw *newWorkPackage) (*hal.WorkPackage, error) {
+	var w *hal.WorkPackage
+	entry := &AuditEntry{
+		Operation: "create work package",
+		After:     nw.Subject,
+	}
+	err := u.writeBack(entry, func() error {
+		w = hal.NewWorkPackage()
+		w.SetSubject(nw.Subject)
+		w.SetDescription("markdown", nw.Description, "")
+
+		res, err := proj.AddWorkPackage(u.hal, w)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if w, ok = res.(*hal.WorkPackage); !ok {
+			return fmt.Errorf("Expected a WorkPackage resource: %+v", res)
+		}
+		entry.WorkPackageID = w.Id()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if w == nil {
+		// Read-only
+		return nil, errReadOnlyUser
+	}
+
+	for _, at := range nw.Attachments {
+		entry := &AuditEntry{
+			WorkPackageID: w.Id(),
+			Operation:     "add attachment",
+			After:         at.FileName,
+		}
+		err := u.writeBack(entry, func() error {
+			_, err := w.AddAttachment(u.hal, at.FileName, at.ContentType, bytes.NewReader(at.Data))
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to upload attachment '%s' to work package %d: %v", at.FileName, w.Id(), err)
+		}
+	}
+	return w, nil
+}
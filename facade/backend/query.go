@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	hal "github.com/lectio/go-json-hal"
+)
+
+// Mailbox with a sub-folder for each of the user's saved queries.
+var queriesMailbox = "Queries"
+
+func queryURL(queryID int) string {
+	return fmt.Sprintf("/api/v3/queries/%d", queryID)
+}
+
+// isUserQuery checks if the query is starred or saved by the user.
+func (u *User) isUserQuery(query *hal.Query) bool {
+	return query.Starred() || linkID(query.GetLink("user")) == u.user.Id()
+}
+
+func (u *User) updateQueries() error {
+	u.Lock()
+	defer u.Unlock()
+
+	// Get first page of queries
+	col, err := u.hal.GetCollection("/api/v3/queries")
+	if err != nil {
+		return fmt.Errorf("Failed to get queries: %s", err)
+	}
+
+	queries := make(map[int]*hal.Query)
+	if err := u.loadQueries(col, queries); err != nil {
+		return err
+	}
+	u.createQueries(queries)
+	return nil
+}
+
+// loadQueries collects the user's queries from all pages of the collection.
+func (u *User) loadQueries(col *hal.Collection, queries map[int]*hal.Query) error {
+	for _, itemRes := range col.Items() {
+		query, ok := itemRes.(*hal.Query)
+		if !ok {
+			return fmt.Errorf("Invalid resource type: %s", itemRes.ResourceType())
+		}
+		if u.isUserQuery(query) {
+			queries[query.Id()] = query
+		}
+	}
+
+	// Check for next page of queries.  All pages are needed to find the
+	// deleted queries.
+	if col.IsPaginated() {
+		nextCol, err := col.NextPage(u.hal)
+		if err != nil {
+			return fmt.Errorf("Failed to get queries: %s", err)
+		}
+		return u.loadQueries(nextCol, queries)
+	}
+	return nil
+}
+
+// createQueries creates a mailbox for each query.  Mailboxes of renamed
+// queries are renamed and mailboxes of deleted queries are removed.
+func (u *User) createQueries(queries map[int]*hal.Query) {
+	if len(queries) > 0 {
+		u.createNoSelectMailbox(queriesMailbox)
+	}
+
+	// Update existing query mailboxes.
+	var mboxes []*Mailbox
+	for _, mbox := range u.mailboxes {
+		if mbox.QueryID > 0 {
+			mboxes = append(mboxes, mbox)
+		}
+	}
+	for _, mbox := range mboxes {
+		query, ok := queries[mbox.QueryID]
+		if !ok {
+			log.Printf("--- Remove mailbox of deleted query: %s", mbox.Name())
+			u.removeMailbox(mbox)
+			continue
+		}
+		delete(queries, mbox.QueryID)
+
+		name := queryMailboxName(query)
+		if name != mbox.Name() {
+			log.Printf("--- Rename mailbox of query: %s -> %s", mbox.Name(), name)
+			if err := u.renameMailbox(mbox.Name(), name); err != nil {
+				log.Printf("Failed to rename query mailbox: %v", err)
+			}
+		}
+	}
+
+	// Create mailboxes for new queries.
+	for _, query := range queries {
+		name := queryMailboxName(query)
+		if _, ok := u.mailboxes[name]; ok {
+			log.Printf("Mailbox already exists for query: %s", name)
+			continue
+		}
+		mbox := NewQueryMailbox(u, name, query)
+		u.mailboxes[name] = mbox
+
+		// Auto subscribe to query mailboxes
+		_ = mbox.SetSubscribed(true)
+	}
+}
+
+func queryMailboxName(query *hal.Query) string {
+	return queriesMailbox + Delimiter + escapeMailboxName(strings.TrimSpace(query.Name()))
+}
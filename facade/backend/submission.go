@@ -0,0 +1,217 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-smtp"
+)
+
+var (
+	// Parse work package id from generated Message-IDs.
+	messageIDRegexp = regexp.MustCompile(`^<work-package-(\d+)[.@]`)
+
+	// Lines that start the quoted part of a reply.
+	quoteHeaderRegexp = regexp.MustCompile(`^(On .* wrote:|-+ ?Original Message ?-+|_{10,})$`)
+)
+
+// Submission is a SMTP backend that posts replies to work package messages as
+// comments on the work package.
+type Submission struct {
+	backend *Backend
+}
+
+func (be *Backend) NewSubmission() *Submission {
+	return &Submission{
+		backend: be,
+	}
+}
+
+// Login uses the same username/API key login as the IMAP backend.
+func (s *Submission) Login(state *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	connInfo := &imap.ConnInfo{
+		RemoteAddr: state.RemoteAddr,
+		LocalAddr:  state.LocalAddr,
+	}
+	u, err := s.backend.Login(connInfo, username, password)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := u.(*User)
+	if !ok {
+		return nil, errBadLogin
+	}
+	return &submissionSession{
+		user: user,
+	}, nil
+}
+
+func (s *Submission) AnonymousLogin(state *smtp.ConnectionState) (smtp.Session, error) {
+	return nil, smtp.ErrAuthRequired
+}
+
+type submissionSession struct {
+	user *User
+
+	from string
+	to   []string
+}
+
+func (s *submissionSession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *submissionSession) Logout() error {
+	return nil
+}
+
+func (s *submissionSession) Mail(from string, opts smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *submissionSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *submissionSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// Create a new work package for messages sent to a project address.
+	for _, to := range s.to {
+		if projectID := projectAddress.Parse(to); projectID > 0 {
+			log.Printf("--- Create work package in project: %d", projectID)
+			return s.user.createWorkPackageFromMessage(projectID, b)
+		}
+	}
+
+	ent, err := message.Read(bytes.NewReader(b))
+	if err != nil && ent == nil {
+		return err
+	}
+
+	workID := s.findWorkPackage(ent.Header)
+	if workID == 0 {
+		return errors.New("Message isn't a reply to a work package")
+	}
+
+	text, err := messageText(ent)
+	if err != nil {
+		return err
+	}
+	comment := stripQuotedText(text)
+	if comment == "" {
+		return errors.New("Reply is empty")
+	}
+
+	log.Printf("--- Add comment to work package: %d", workID)
+	if err := s.user.addWorkPackageComment(workID, comment); err != nil {
+		log.Printf("Failed to add comment to work package %d: %v", workID, err)
+		return err
+	}
+
+	// Show the new comment right away.
+	s.user.refreshWorkPackage(workID)
+	return nil
+}
+
+// findWorkPackage gets the work package id from the reply's recipients or the
+// In-Reply-To/References headers.
+func (s *submissionSession) findWorkPackage(hdr message.Header) int {
+	for _, to := range s.to {
+		if id := replyAddress.Parse(to); id > 0 {
+			return id
+		}
+	}
+	ids := strings.Fields(hdr.Get("In-Reply-To"))
+	// Check newest references first.
+	refs := strings.Fields(hdr.Get("References"))
+	for i := len(refs) - 1; i >= 0; i-- {
+		ids = append(ids, refs[i])
+	}
+	for _, msgID := range ids {
+		if id := parseWorkPackageMessageID(msgID); id > 0 {
+			return id
+		}
+	}
+	return 0
+}
+
+func parseWorkPackageMessageID(msgID string) int {
+	msgID = strings.TrimSpace(msgID)
+	m := messageIDRegexp.FindStringSubmatch(msgID)
+	if m == nil || !strings.HasSuffix(msgID, "@"+messageIDHost+">") {
+		return 0
+	}
+	id, _ := strconv.Atoi(m[1])
+	return id
+}
+
+// messageText returns the first 'text/plain' part of the message.
+func messageText(ent *message.Entity) (string, error) {
+	if mr := ent.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return "", err
+			}
+			if text, err := messageText(part); err == nil {
+				return text, nil
+			}
+		}
+		return "", errors.New("Message doesn't have a text part")
+	}
+
+	t, _, _ := ent.Header.ContentType()
+	if t != "" && t != "text/plain" {
+		return "", fmt.Errorf("Unsupported content type: %s", t)
+	}
+	b, err := ioutil.ReadAll(ent.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// stripQuotedText removes the quoted message and signature from a reply.
+func stripQuotedText(text string) string {
+	var lines []string
+	all := strings.Split(text, "\n")
+	for i, line := range all {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "--" || isQuoteHeader(line) {
+			// Signature or start of quoted message.
+			break
+		}
+		// Clients wrap long "On ... wrote:" lines.
+		if strings.HasPrefix(line, "On ") && i+1 < len(all) &&
+			isQuoteHeader(line+" "+strings.TrimSpace(all[i+1])) {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func isQuoteHeader(line string) bool {
+	return quoteHeaderRegexp.MatchString(line)
+}
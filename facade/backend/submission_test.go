@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripQuotedText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "plain reply",
+			text: "Looks good to me.\r\n",
+			want: "Looks good to me.",
+		},
+		{
+			name: "gmail",
+			text: "Fixed in the latest build.\r\n\r\n" +
+				"On Mon, Oct 14, 2019 at 10:02 AM OpenProject <reply+12@example.com> wrote:\r\n" +
+				"> Login page shows a blank screen\r\n" +
+				"> after upgrading.\r\n",
+			want: "Fixed in the latest build.",
+		},
+		{
+			name: "wrapped quote header",
+			text: "Fixed in the latest build.\n\n" +
+				"On Mon, Oct 14, 2019 at 10:02 AM OpenProject Facade\n" +
+				"<reply+12@example.com> wrote:\n" +
+				"> Login page shows a blank screen\n",
+			want: "Fixed in the latest build.",
+		},
+		{
+			name: "thunderbird",
+			text: "Can you attach the logs?\n\n" +
+				"On 10/14/19 10:02 AM, OpenProject wrote:\n" +
+				"> Login page shows a blank screen\n",
+			want: "Can you attach the logs?",
+		},
+		{
+			name: "outlook",
+			text: "I'll take this one.\r\n\r\n" +
+				"-----Original Message-----\r\n" +
+				"From: OpenProject <reply+12@example.com>\r\n" +
+				"Sent: Monday, October 14, 2019 10:02 AM\r\n",
+			want: "I'll take this one.",
+		},
+		{
+			name: "signature",
+			text: "Done.\n\n-- \nJane Doe\nExample Inc.\n",
+			want: "Done.",
+		},
+		{
+			name: "inline quotes",
+			text: "> Which browser?\nFirefox 69.\n> Which OS?\nLinux.\n",
+			want: "Firefox 69.\nLinux.",
+		},
+		{
+			name: "sentence starting with On",
+			text: "On second thought, let's wait.\nThe release is on Friday.\n",
+			want: "On second thought, let's wait.\nThe release is on Friday.",
+		},
+		{
+			name: "long line",
+			text: strings.Repeat("x", 100*1024) + "\nend\n",
+			want: strings.Repeat("x", 100*1024) + "\nend",
+		},
+	}
+	for _, tt := range tests {
+		if got := stripQuotedText(tt.text); got != tt.want {
+			t.Errorf("%s: stripQuotedText() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
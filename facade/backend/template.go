@@ -37,25 +37,72 @@ type WorkPackageMessage struct {
 	Subject string
 
 	WordCount int
+
+	// Activity log (comments and field changes), oldest first.
+	Activities []*Activity
 }
 
-func (wpMsg *WorkPackageMessage) ReadingTime() string {
-	mins := ReadingTime(wpMsg.WordCount)
-	return fmt.Sprintf("%d minute read", int(mins.Minutes()))
+// Activity is a comment and/or list of field changes made to a work package.
+type Activity struct {
+	Id     int
+	Date   time.Time
+	Author string
+	// Last time the comment was edited.  Same as Date if never edited.
+	UpdatedAt time.Time
+
+	comment *hal.Formattable
+	details []*hal.Formattable
 }
 
-func (wpMsg *WorkPackageMessage) Description(format string) interface{} {
-	desc := wpMsg.WorkPackage.Description()
-	if desc != nil {
+func formatText(text *hal.Formattable, format string) interface{} {
+	if text != nil {
 		if format == "html" {
-			return template.HTML(desc.Html)
+			return template.HTML(text.Html)
 		} else if format == "text" {
-			return desc.Raw
+			return text.Raw
 		}
 	}
 	return ""
 }
 
+func (a *Activity) Comment(format string) interface{} {
+	return formatText(a.comment, format)
+}
+
+func (a *Activity) HasComment() bool {
+	return a.comment != nil && a.comment.Raw != ""
+}
+
+func (a *Activity) Details(format string) []interface{} {
+	details := []interface{}{}
+	for _, detail := range a.details {
+		details = append(details, formatText(detail, format))
+	}
+	return details
+}
+
+func (wpMsg *WorkPackageMessage) ReadingTime() string {
+	mins := ReadingTime(wpMsg.WordCount)
+	return fmt.Sprintf("%d minute read", int(mins.Minutes()))
+}
+
+func (wpMsg *WorkPackageMessage) Description(format string) interface{} {
+	return formatText(wpMsg.WorkPackage.Description(), format)
+}
+
+// CommentMessage is used to generate a message for a single work package
+// comment.
+type CommentMessage struct {
+	user *User
+	// WorkPackage
+	WorkPackage *hal.WorkPackage
+	Activity    *Activity
+
+	// Message
+	Date    time.Time
+	Subject string
+}
+
 type EmailTemplate struct {
 	template.Template
 }
@@ -79,19 +126,40 @@ func NewEmailTemplate(cfg *viper.Viper) (*EmailTemplate, error) {
 	return tpl, nil
 }
 
-func (tpl *EmailTemplate) generatePart(name string, wpMsg *WorkPackageMessage) ([]byte, error) {
+func (tpl *EmailTemplate) generatePart(name string, data interface{}) ([]byte, error) {
 	var b bytes.Buffer
-	if err := tpl.ExecuteTemplate(&b, name+".tpl", wpMsg); err != nil {
+	if err := tpl.ExecuteTemplate(&b, name+".tpl", data); err != nil {
 		log.Printf("Failed to generate '%s' part of work package email: %v", name, err)
 		return nil, err
 	}
 	return b.Bytes(), nil
 }
 
-func (tpl *EmailTemplate) Generate(user *User, w *hal.WorkPackage) (*Message, error) {
+// workPackageSubject returns the subject of the work package with the
+// Important marker `!1` removed.
+func workPackageSubject(w *hal.WorkPackage) (string, bool) {
+	subject := w.Subject()
+	if strings.HasSuffix(subject, " !1") {
+		return strings.TrimSuffix(subject, " !1"), true
+	}
+	return subject, false
+}
+
+// workPackageReferences returns the Message-IDs the work package's message
+// should reference.
+func workPackageReferences(w *hal.WorkPackage) []string {
+	refs := []string{}
+	if parentID := linkID(w.GetLink("parent")); parentID > 0 {
+		refs = append(refs, workPackageMessageID(parentID))
+	}
+	return refs
+}
+
+func (tpl *EmailTemplate) Generate(user *User, w *hal.WorkPackage, activities []*Activity) (*Message, error) {
 	wpMsg := &WorkPackageMessage{
 		user:        user,
 		WorkPackage: w,
+		Activities:  activities,
 	}
 
 	flags := []string{}
@@ -103,8 +171,10 @@ func (tpl *EmailTemplate) Generate(user *User, w *hal.WorkPackage) (*Message, er
 	if dt := w.GetCreatedAt(); dt != nil {
 		date = *dt
 	}
+	var updatedAt time.Time
 	if dt := w.GetUpdatedAt(); dt != nil {
 		date = *dt
+		updatedAt = *dt
 	}
 	wpMsg.Date = date
 	e.Headers.Add("Date", date.Format(time.RFC1123Z))
@@ -121,17 +191,28 @@ func (tpl *EmailTemplate) Generate(user *User, w *hal.WorkPackage) (*Message, er
 	if cc != "" {
 		e.Cc = []string{cc}
 	}
+	if reply := replyAddress.Format(w.Id()); reply != "" {
+		e.ReplyTo = []string{reply}
+	}
 
 	// Subject
-	subject := w.Subject()
+	subject, important := workPackageSubject(w)
 	// Check for Important marker `!1`
-	if strings.HasSuffix(subject, " !1") {
-		subject = strings.TrimSuffix(subject, " !1")
+	if important {
 		flags = append(flags, imap.FlaggedFlag, "Important")
 	}
 	wpMsg.Subject = subject
 	e.Subject = subject
 
+	// Comment messages reply to this message, child work packages reply to
+	// their parent's message.
+	msgID := workPackageMessageID(w.Id())
+	e.Headers.Set("Message-ID", msgID)
+	if refs := workPackageReferences(w); len(refs) > 0 {
+		e.Headers.Set("In-Reply-To", refs[len(refs)-1])
+		e.Headers.Set("References", strings.Join(refs, " "))
+	}
+
 	// Estimate reading time based on description word count
 	if desc := w.Description(); desc != nil {
 		// Based on: http://www.craigabbott.co.uk/how-to-calculate-reading-time-like-medium
@@ -179,12 +260,86 @@ func (tpl *EmailTemplate) Generate(user *User, w *hal.WorkPackage) (*Message, er
 		Flags:         flags,
 		Size:          uint32(len(buf)),
 		WorkPackageID: w.Id(),
+		UpdatedAt:     updatedAt,
+		MessageID:     msgID,
 		body:          buf,
 		WordCount:     wpMsg.WordCount,
 	}
 
 	// Try loading flags stored in OpenProject
-	wpMsg.user.loadWorkPackageFlags(msg)
+	wpMsg.user.loadWorkPackageFlags(w, msg)
+	// Flags mapped to work package fields
+	msg.Flags = applyFieldFlags(msg.Flags, w)
+
+	return msg, nil
+}
+
+// GenerateComment builds a message for a single work package comment.  The
+// message is threaded as a reply to the work package's message.
+func (tpl *EmailTemplate) GenerateComment(user *User, w *hal.WorkPackage, act *Activity) (*Message, error) {
+	subject, _ := workPackageSubject(w)
+	cMsg := &CommentMessage{
+		user:        user,
+		WorkPackage: w,
+		Activity:    act,
+		Date:        act.Date,
+		Subject:     "Re: " + subject,
+	}
+
+	// Build message
+	e := email.NewEmail()
+	e.Headers.Add("Date", cMsg.Date.Format(time.RFC1123Z))
+
+	// From, To
+	to, _ := cMsg.user.getCachedAddress(w.GetLink("assignee"))
+	e.From = act.Author
+	if to != "" {
+		e.To = []string{to}
+	}
+	if reply := replyAddress.Format(w.Id()); reply != "" {
+		e.ReplyTo = []string{reply}
+	}
+	e.Subject = cMsg.Subject
+
+	// Thread comment under the work package message
+	rootID := workPackageMessageID(w.Id())
+	msgID := activityMessageID(w.Id(), act.Id)
+	refs := append(workPackageReferences(w), rootID)
+	e.Headers.Set("Message-ID", msgID)
+	e.Headers.Set("In-Reply-To", rootID)
+	e.Headers.Set("References", strings.Join(refs, " "))
+
+	// Generate text & html parts
+	if data, err := tpl.generatePart("comment-html", cMsg); err != nil {
+		return nil, err
+	} else {
+		e.HTML = data
+	}
+	if data, err := tpl.generatePart("comment-text", cMsg); err != nil {
+		return nil, err
+	} else {
+		e.Text = data
+	}
+
+	buf, err := e.Bytes()
+	if err != nil {
+		log.Printf("Failed to build comment message: subject=%s, err=%s", w.Subject(), err)
+		return nil, err
+	}
+
+	msg := &Message{
+		Date:          cMsg.Date,
+		Flags:         []string{},
+		Size:          uint32(len(buf)),
+		WorkPackageID: w.Id(),
+		UpdatedAt:     act.UpdatedAt,
+		ActivityID:    act.Id,
+		MessageID:     msgID,
+		body:          buf,
+	}
+	if act.comment != nil {
+		msg.WordCount = WordCount(act.comment.Raw)
+	}
 
 	return msg, nil
 }
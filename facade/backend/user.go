@@ -24,24 +24,36 @@ type User struct {
 
 	hal *hal.HalClient
 
-	backend   *Backend
-	username  string
-	password  string // Cached password for faster sync
-	email     string
-	mailboxes map[string]*Mailbox
+	backend    *Backend
+	username   string
+	apiKeyHash []byte // Hash of the API key for faster logins
+	email      string
+	mailboxes  map[string]*Mailbox
 
 	// per-user cache
 	store storm.Node
 
+	// Storage for message flags
+	flagStore FlagStore
+	// Don't make any changes in OpenProject.
+	readOnly bool
+
+	// Work package to mailbox index
+	indexLock sync.Mutex
+	index     *workIndex
+
 	// Time Entries
 	teLock      sync.RWMutex
 	activity    *hal.Link
 	timeEntries map[string]*hal.TimeEntry
 
 	user *hal.User
+
+	// Closed to stop the background updater.
+	stop chan struct{}
 }
 
-func NewUser(backend *Backend, hc *hal.HalClient, userRes *hal.User, password string) *User {
+func NewUser(backend *Backend, hc *hal.HalClient, userRes *hal.User, apiKey string) *User {
 	email := userRes.Email()
 	if email == "" {
 		email = userRes.Login()
@@ -59,24 +71,17 @@ func NewUser(backend *Backend, hc *hal.HalClient, userRes *hal.User, password st
 		hal:         hc,
 		user:        userRes,
 		username:    username,
-		password:    password,
+		apiKeyHash:  hashAPIKey(apiKey),
 		email:       email,
 		mailboxes:   map[string]*Mailbox{},
 		store:       store,
 		timeEntries: map[string]*hal.TimeEntry{},
+		readOnly:    backend.isReadOnly(username),
+		index:       newWorkIndex(),
+		stop:        make(chan struct{}),
 	}
 
-	// Get time entry activity url
-	if actLink, err := backend.FindTimeEntryActivityURL(hc, activityName); err == nil {
-		user.activity = actLink
-	} else {
-		log.Fatal("Failed to find time entry activity url:", err)
-	}
-
-	// Load time entries
-	if err := user.loadTimeEntries(); err != nil {
-		log.Println("Error loading user's time entries:", err)
-	}
+	user.flagStore = newFlagStore(user)
 
 	// load mailboxes
 	var mboxes []*Mailbox
@@ -85,6 +90,7 @@ func NewUser(backend *Backend, hc *hal.HalClient, userRes *hal.User, password st
 	}
 	for _, mbox := range mboxes {
 		user.appendMailbox(mbox, false)
+		user.indexMailbox(mbox)
 	}
 
 	if inbox, err := user.createMailbox("INBOX", ""); err == nil {
@@ -93,6 +99,8 @@ func NewUser(backend *Backend, hc *hal.HalClient, userRes *hal.User, password st
 	if _, err := user.createMailbox("Trash", specialuse.Trash); err != nil {
 		log.Println("Failed to create mailbox:", err)
 	}
+	user.createVirtualMailbox("Assigned to me", "assignee")
+	user.createVirtualMailbox("Responsible", "responsible")
 
 	// Initial update
 	user.runUpdate(true)
@@ -109,15 +117,54 @@ func (u *User) createWelcomeMessage(mbox *Mailbox) {
 		"Welcome to the lectio IMAP facade for OpenProjects."
 	html := "<html><head></head><body>" + body + "</body></html>"
 
-	msg, _ := buildSimpleMessage("contact@"+emailDomain,
+	msg, _ := buildSimpleMessage(welcomeMessageID(u.username), "contact@"+emailDomain,
 		formatEmailAddress(u.user), "",
 		"Welcome new lectio user", body, html)
 
 	mbox.appendMessage(msg)
 }
 
-func (u *User) GenerateMessage(w *hal.WorkPackage) (*Message, error) {
-	return u.backend.GenerateMessage(u, w)
+func (u *User) GenerateMessage(w *hal.WorkPackage, activities []*Activity) (*Message, error) {
+	return u.backend.GenerateMessage(u, w, activities)
+}
+
+func (u *User) GenerateComment(w *hal.WorkPackage, act *Activity) (*Message, error) {
+	return u.backend.GenerateComment(u, w, act)
+}
+
+// LoadActivities loads the work package's comments and field changes.
+func (u *User) LoadActivities(w *hal.WorkPackage) []*Activity {
+	col := w.GetActivities(u.hal)
+	if col == nil {
+		return nil
+	}
+	var activities []*Activity
+	for _, res := range col.Items() {
+		actRes, ok := res.(*hal.Activity)
+		if !ok {
+			log.Printf("Invalid activity=%+v", res)
+			continue
+		}
+		act := &Activity{
+			Id:      actRes.Id(),
+			comment: actRes.Comment(),
+			details: actRes.Details(),
+		}
+		if len(act.details) == 0 && !act.HasComment() {
+			// Nothing to show.
+			continue
+		}
+		if dt := actRes.GetCreatedAt(); dt != nil {
+			act.Date = *dt
+		}
+		act.UpdatedAt = act.Date
+		if dt := actRes.GetUpdatedAt(); dt != nil {
+			act.UpdatedAt = *dt
+		}
+		act.Author, _ = u.getCachedAddress(actRes.GetLink("user"))
+		activities = append(activities, act)
+	}
+	return activities
 }
 
 func (u *User) LoadAttachment(at *hal.Attachment) (io.Reader, error) {
@@ -140,82 +187,47 @@ func (u *User) updater(interval int) {
 	u.updateMailboxes()
 
 	for {
-		time.Sleep(time.Second * time.Duration(interval))
+		select {
+		case <-u.stop:
+			log.Println("User updater: stopped.")
+			return
+		case <-time.After(time.Second * time.Duration(interval)):
+		}
 
 		// Update project mailboxes
 		u.runUpdate(false)
 	}
 }
 
-func (u *User) updateWorkPackageFlags(msg *Message) error {
-	u.teLock.Lock()
-	defer u.teLock.Unlock()
-
-	te, err := u.getTimeEntry(msg.WorkPackageID, true)
-	if err != nil {
-		return err
-	}
-	flags := strings.Join(msg.Flags, ",")
-	te.SetComment("plain", flags, flags)
-
-	// Check for 'Seen' flag
-	seen := false
-	for _, flag := range msg.Flags {
-		if flag == imap.SeenFlag {
-			seen = true
-		}
-	}
-
-	if seen {
-		te.SetHours(msg.ReadingTime())
-		te.SetSpentOn(time.Now())
-	} else {
-		te.SetHours(0)
-	}
-
-	// Record changes.
-	if res, err := te.Update(u.hal); err != nil {
-		return err
-	} else {
-		// Store updated time entry
-		if updatedEntry, ok := res.(*hal.TimeEntry); ok {
-			te = updatedEntry
-		}
-	}
-	// Get Work package url
-	workLink := te.GetLink("workPackage")
-	if workLink == nil {
-		// Not a work package time entry, ignore it.
-		return fmt.Errorf("Updated time entry missing work package url.")
-	}
-	workURL := workLink.Href
-
-	// Store updated time entry
-	u.timeEntries[workURL] = te
-
-	return nil
+// stopUpdater stops the background updater of a user that was replaced or
+// dropped from the logged in users.
+func (u *User) stopUpdater() {
+	close(u.stop)
 }
 
-func (u *User) loadWorkPackageFlags(msg *Message) {
-	u.teLock.Lock()
-	defer u.teLock.Unlock()
+func (u *User) updateWorkPackageFlags(msg *Message) error {
+	// Don't store `\Deleted`, it only applies to this copy of the message.
+	stored := *msg
+	stored.Flags = sharedFlags(msg.Flags)
+	err := u.flagStore.SaveFlags(&stored)
+	// Flag stores can change the work package's 'updatedAt'.
+	msg.UpdatedAt = stored.UpdatedAt
+	return err
+}
 
-	te, _ := u.getTimeEntry(msg.WorkPackageID, false)
-	if te == nil {
-		// no time entry or error.  Don't modify the Message.
+func (u *User) loadWorkPackageFlags(w *hal.WorkPackage, msg *Message) {
+	flags, err := u.flagStore.LoadFlags(w)
+	if err != nil {
+		log.Printf("Failed to load flags of work package %d: %v", w.Id(), err)
 		return
 	}
-	comment := te.Comment()
-	if comment != nil && comment.Raw != "" {
-		flags := strings.Split(comment.Raw, ",")
-		if len(flags) > 0 {
-			msg.Flags = flags
-		}
+	if len(flags) > 0 {
+		msg.Flags = sharedFlags(flags)
 	}
 }
 
 func (u *User) getTimeEntry(work_id int, create bool) (*hal.TimeEntry, error) {
-	workURL := fmt.Sprintf("/api/v3/work_packages/%d", work_id)
+	workURL := workPackageURL(work_id)
 
 	// Look for existing Time Entry
 	if te, ok := u.timeEntries[workURL]; ok {
@@ -227,15 +239,9 @@ func (u *User) getTimeEntry(work_id int, create bool) (*hal.TimeEntry, error) {
 	}
 
 	// Load work package
-	var ok bool
-	var w *hal.WorkPackage
-	if res, err := u.hal.Get(workURL); err != nil {
-		return nil, fmt.Errorf("Failed to load work package: %d", work_id)
-	} else {
-		w, ok = res.(*hal.WorkPackage)
-		if !ok {
-			return nil, fmt.Errorf("Expected a WorkPackage resource: %+v", res)
-		}
+	w, err := u.getWorkPackage(work_id)
+	if err != nil {
+		return nil, err
 	}
 
 	// Test creating TimeEntry
@@ -243,7 +249,16 @@ func (u *User) getTimeEntry(work_id int, create bool) (*hal.TimeEntry, error) {
 	te.SetHours(1 * time.Second)
 	te.SetComment("plain", "", "")
 	te.SetActivity(u.activity.Href)
-	if res, err := w.AddTimeEntry(u.hal, te); err != nil {
+	var res hal.Resource
+	entry := &AuditEntry{
+		WorkPackageID: work_id,
+		Operation:     "create time entry",
+	}
+	err = u.writeBack(entry, func() error {
+		res, err = w.AddTimeEntry(u.hal, te)
+		return err
+	})
+	if err != nil {
 		if resErr, ok := err.(*hal.Error); ok {
 			if resErr.ErrorIdentifier() == "urn:openproject-org:api:v3:errors:MissingPermission" {
 				return nil, fmt.Errorf("Permission denied creating time entry.  Make sure the 'Time tracking' module is enabled for this project.")
@@ -251,6 +266,7 @@ func (u *User) getTimeEntry(work_id int, create bool) (*hal.TimeEntry, error) {
 		}
 		return nil, err
 	} else {
+		var ok bool
 		te, ok = res.(*hal.TimeEntry)
 		if !ok {
 			return nil, fmt.Errorf("Expected a TimeEntry resource: %+v", res)
@@ -284,10 +300,10 @@ func (u *User) processTimeEntries(col *hal.Collection) error {
 		u.processTimeEntry(te)
 	}
 
-	// Check for next page of projects.
+	// Check for next page of time entries.
 	if col.IsPaginated() {
 		if nextCol, err := col.NextPage(u.hal); err == nil {
-			return u.createProjects(nextCol)
+			return u.processTimeEntries(nextCol)
 		}
 	}
 	return nil
@@ -324,6 +340,39 @@ func (u *User) processTimeEntry(te *hal.TimeEntry) {
 	u.timeEntries[workURL] = te
 }
 
+// refreshWorkPackage updates the messages of a work package right away,
+// instead of waiting for the next update.
+func (u *User) refreshWorkPackage(workID int) {
+	w, err := u.getWorkPackage(workID)
+	if err != nil {
+		log.Println("Failed to refresh work package:", err)
+		return
+	}
+
+	u.RLock()
+	projectSynced := false
+	for _, mbox := range u.mailboxes {
+		if !mbox.hasWorkPackage(workID) {
+			continue
+		}
+		if mbox.isVirtual() {
+			err = mbox.workPackageToMessage(u.hal, w)
+		} else if mbox.ProjectID > 0 && !projectSynced {
+			// Only sync once, the work package might move to another folder.
+			projectSynced = true
+			err = mbox.syncWorkPackage(u.hal, w)
+		} else {
+			continue
+		}
+		if err != nil {
+			log.Printf("--- Failed to update message from work package: %s", w.Subject())
+		}
+	}
+	u.RUnlock()
+
+	u.syncInbox()
+}
+
 func (u *User) runUpdate(firstTime bool) {
 	log.Println("Run update.")
 
@@ -332,6 +381,11 @@ func (u *User) runUpdate(firstTime bool) {
 		log.Printf("Failed to get projects: %v", err)
 	}
 
+	// Update saved queries
+	if err := u.updateQueries(); err != nil {
+		log.Printf("Failed to get queries: %v", err)
+	}
+
 	if firstTime {
 		// skip mailbox update the first time.
 		return
@@ -339,6 +393,9 @@ func (u *User) runUpdate(firstTime bool) {
 
 	// Update mailboxes
 	u.updateMailboxes()
+
+	// Copy work package messages to INBOX
+	u.syncInbox()
 }
 
 func (u *User) updateMailboxes() {
@@ -360,30 +417,129 @@ func (u *User) updateProjects() error {
 		return fmt.Errorf("Failed to get projects: %s", err)
 	}
 
-	return u.createProjects(col)
+	projects := make(map[int]*hal.Project)
+	if err := u.loadProjects(col, projects); err != nil {
+		return err
+	}
+	u.createProjects(projects)
+	return nil
 }
 
-func (u *User) createProjects(col *hal.Collection) error {
+// loadProjects collects the projects from all pages of the collection.
+func (u *User) loadProjects(col *hal.Collection, projects map[int]*hal.Project) error {
 	for _, itemRes := range col.Items() {
 		proj, ok := itemRes.(*hal.Project)
 		if !ok {
 			return fmt.Errorf("Invalid resource type: %s", itemRes.ResourceType())
 		}
+		projects[proj.Id()] = proj
+	}
+
+	// Check for next page of projects.  All pages are needed to find the
+	// projects that are no longer accessible.
+	if col.IsPaginated() {
+		nextCol, err := col.NextPage(u.hal)
+		if err != nil {
+			return fmt.Errorf("Failed to get projects: %s", err)
+		}
+		return u.loadProjects(nextCol, projects)
+	}
+	return nil
+}
+
+func (u *User) createProjects(projects map[int]*hal.Project) {
+	for _, proj := range projects {
 		// Create mailbox if it doesn't exist.
-		mbox, _ := u.createProjectMailbox(proj)
+		mbox, _ := u.createProjectMailbox(projectMailboxName(projects, proj), proj)
 		if mbox.project == nil {
 			mbox.project = proj
 			mbox.ProjectID = proj.Id()
 		}
+		u.indexMailbox(mbox)
+		u.createStatusMailboxes(mbox)
 	}
 
-	// Check for next page of projects.
-	if col.IsPaginated() {
-		if nextCol, err := col.NextPage(u.hal); err == nil {
-			return u.createProjects(nextCol)
+	u.archiveProjects(projects)
+}
+
+// archiveProjects moves the mailboxes of projects that were archived or
+// aren't accessible anymore to the archive mailbox, or removes them if there
+// is no archive mailbox.
+func (u *User) archiveProjects(projects map[int]*hal.Project) {
+	for _, mbox := range u.projectMailboxes() {
+		if _, ok := projects[mbox.ProjectID]; ok || mbox.Archived {
+			continue
+		}
+		if archiveMailbox == "" {
+			log.Printf("--- Remove mailbox of inaccessible project: %s", mbox.Name())
+			u.removeProjectMailbox(mbox)
+			continue
+		}
+
+		name := archiveMailbox + Delimiter + mbox.Name()
+		log.Printf("--- Archive mailbox of inaccessible project: %s -> %s", mbox.Name(), name)
+		u.createNoSelectMailbox(archiveMailbox)
+		if err := u.renameMailbox(mbox.Name(), name); err != nil {
+			log.Printf("Failed to archive project mailbox: %v", err)
+			continue
+		}
+		// Stop syncing the project.
+		mbox.project = nil
+		for _, folder := range u.projectFolders(mbox) {
+			folder.Archived = true
+			u.updateMailbox(folder)
 		}
 	}
-	return nil
+}
+
+// projectFolders returns the project mailbox and its status folders.
+func (u *User) projectFolders(mbox *Mailbox) []*Mailbox {
+	folders := []*Mailbox{mbox}
+	for _, folder := range u.mailboxes {
+		if folder.ProjectID == mbox.ProjectID && folder.StatusName != "" {
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+// removeProjectMailbox deletes a project mailbox and its status folders.
+func (u *User) removeProjectMailbox(mbox *Mailbox) {
+	u.unindexProject(mbox)
+	for _, folder := range u.projectFolders(mbox) {
+		u.removeMailbox(folder)
+	}
+}
+
+// projectMailboxName returns the mailbox name of the project nested under
+// its parent projects.  Parent projects the user can't see are skipped.
+func projectMailboxName(projects map[int]*hal.Project, proj *hal.Project) string {
+	name := escapeMailboxName(proj.Name())
+	seen := map[int]bool{proj.Id(): true}
+	for {
+		parentID := linkID(proj.GetLink("parent"))
+		parent, ok := projects[parentID]
+		if !ok || seen[parentID] {
+			return name
+		}
+		seen[parentID] = true
+		name = escapeMailboxName(parent.Name()) + Delimiter + name
+		proj = parent
+	}
+}
+
+// hasChildren checks if there are mailboxes below the named mailbox.
+func (u *User) hasChildren(name string) bool {
+	u.RLock()
+	defer u.RUnlock()
+
+	prefix := name + Delimiter
+	for child := range u.mailboxes {
+		if strings.HasPrefix(child, prefix) {
+			return true
+		}
+	}
+	return false
 }
 
 func (u *User) Backend() *Backend {
@@ -455,13 +611,53 @@ func (u *User) createMailbox(name string, specialUse string) (*Mailbox, error) {
 	return mbox, nil
 }
 
-func (u *User) createProjectMailbox(proj *hal.Project) (*Mailbox, bool) {
-	name := proj.Name()
+func (u *User) getProjectMailbox(projectID int) (*Mailbox, error) {
+	u.RLock()
+	defer u.RUnlock()
+
+	for _, mbox := range u.mailboxes {
+		if mbox.ProjectID == projectID && mbox.StatusName == "" {
+			return mbox, nil
+		}
+	}
+	return nil, errors.New("No such project mailbox")
+}
+
+// createWorkPackageFromMessage creates a work package from a message sent to
+// a project's address.
+func (u *User) createWorkPackageFromMessage(projectID int, b []byte) error {
+	mbox, err := u.getProjectMailbox(projectID)
+	if err != nil {
+		return err
+	}
+	return mbox.createWorkPackageFromMessage(b, nil)
+}
+
+func (u *User) createProjectMailbox(name string, proj *hal.Project) (*Mailbox, bool) {
+	// Mailboxes are tied to the project id, renamed projects rename the mailbox.
+	if mbox := u.lookupProject(proj.Id()); mbox != nil {
+		if mbox.Archived {
+			log.Printf("--- Restore archived project mailbox: %s", mbox.Name())
+			for _, folder := range u.projectFolders(mbox) {
+				folder.Archived = false
+				if err := u.store.UpdateField(folder, "Archived", false); err != nil {
+					log.Println("Error updating mailbox:", err)
+				}
+			}
+		}
+		if mbox.Name() != name {
+			log.Printf("--- Rename project mailbox: %s -> %s", mbox.Name(), name)
+			if err := u.renameMailbox(mbox.Name(), name); err != nil {
+				log.Printf("Failed to rename project mailbox: %v", err)
+			}
+		}
+		return mbox, true
+	}
 	if mbox, ok := u.mailboxes[name]; ok {
 		return mbox, true
 	}
 
-	mbox := NewProjectMailbox(u, proj)
+	mbox := NewProjectMailbox(u, name, proj)
 	u.mailboxes[name] = mbox
 
 	// Auto subscribe to project mailboxes
@@ -470,6 +666,47 @@ func (u *User) createProjectMailbox(proj *hal.Project) (*Mailbox, bool) {
 	return mbox, false
 }
 
+// createNoSelectMailbox creates a parent mailbox that can't have messages.
+func (u *User) createNoSelectMailbox(name string) {
+	if _, ok := u.mailboxes[name]; ok {
+		return
+	}
+	mbox := NewMailbox(u, name, "")
+	mbox.Attributes = []string{imap.NoSelectAttr}
+	mbox.saveMailbox()
+	u.mailboxes[name] = mbox
+}
+
+// createVirtualMailbox creates a mailbox for the work packages where the
+// field is the user.
+func (u *User) createVirtualMailbox(name string, filter string) {
+	if _, ok := u.mailboxes[name]; ok {
+		return
+	}
+	mbox := NewVirtualMailbox(u, name, filter)
+	u.mailboxes[name] = mbox
+
+	// Auto subscribe to virtual mailboxes
+	_ = mbox.SetSubscribed(true)
+}
+
+// createStatusMailboxes creates the status folders of a project mailbox.
+func (u *User) createStatusMailboxes(parent *Mailbox) {
+	for _, status := range statusFolders {
+		name := parent.Name() + Delimiter + escapeMailboxName(status)
+		mbox, ok := u.mailboxes[name]
+		if !ok {
+			mbox = NewStatusMailbox(u, parent, status)
+			u.mailboxes[name] = mbox
+
+			// Auto subscribe to status mailboxes
+			_ = mbox.SetSubscribed(true)
+		}
+		mbox.parent = parent
+		parent.statusMailboxes[status] = mbox
+	}
+}
+
 func (u *User) CreateMailbox(name string) error {
 	u.Lock()
 	defer u.Unlock()
@@ -497,15 +734,40 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 	u.Lock()
 	defer u.Unlock()
 
+	return u.renameMailbox(existingName, newName)
+}
+
+func (u *User) renameMailbox(existingName, newName string) error {
 	mbox, ok := u.mailboxes[existingName]
 	if !ok {
 		return errors.New("No such mailbox")
 	}
+	if strings.HasPrefix(newName, existingName+Delimiter) {
+		return errors.New("Cannot move mailbox into itself")
+	}
+
+	if _, ok := u.mailboxes[newName]; ok {
+		return errors.New("Mailbox already exists")
+	}
 
 	// Move mailbox to new name.
 	mbox.MailboxName = newName
 	u.mailboxes[newName] = mbox
 	delete(u.mailboxes, existingName)
+	u.updateMailbox(mbox)
+
+	// Move child mailboxes too.
+	prefix := existingName + Delimiter
+	for name, child := range u.mailboxes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		childName := newName + Delimiter + strings.TrimPrefix(name, prefix)
+		child.MailboxName = childName
+		u.mailboxes[childName] = child
+		delete(u.mailboxes, name)
+		u.updateMailbox(child)
+	}
 
 	if existingName == "INBOX" {
 		// Create a new INBOX
@@ -517,6 +779,18 @@ func (u *User) RenameMailbox(existingName, newName string) error {
 	return nil
 }
 
+// removeMailbox deletes the mailbox and its messages from storage.
+func (u *User) removeMailbox(mbox *Mailbox) {
+	delete(u.mailboxes, mbox.Name())
+
+	if err := u.store.From("mailboxes").Drop(strconv.Itoa(mbox.Id)); err != nil {
+		log.Println("Error deleting mailbox messages:", err)
+	}
+	if err := u.store.DeleteStruct(mbox); err != nil {
+		log.Println("Error deleting mailbox:", err)
+	}
+}
+
 func (u *User) PushMailboxUpdate(mbox *Mailbox) {
 	update := &backend.MailboxUpdate{}
 	update.Update = backend.NewUpdate(u.username, mbox.Name())
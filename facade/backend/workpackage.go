@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+// newWorkPackage is a work package parsed from an email message.
+type newWorkPackage struct {
+	Subject     string
+	Description string
+	Attachments []*newAttachment
+}
+
+type newAttachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+// parseNewWorkPackage uses the message's subject, text body and attachments
+// for a new work package.
+func parseNewWorkPackage(b []byte) (*newWorkPackage, error) {
+	ent, err := message.Read(bytes.NewReader(b))
+	if err != nil && ent == nil {
+		return nil, err
+	}
+
+	hdr := mail.Header{Header: ent.Header}
+	subject, err := hdr.Subject()
+	if err != nil {
+		subject = ent.Header.Get("Subject")
+	}
+	subject = strings.TrimSpace(subject)
+	if subject == "" {
+		return nil, errors.New("Message is missing a subject")
+	}
+
+	nw := &newWorkPackage{
+		Subject: subject,
+	}
+	if err := nw.parseEntity(ent); err != nil {
+		return nil, err
+	}
+	nw.Description = strings.TrimSpace(nw.Description)
+	return nw, nil
+}
+
+func (nw *newWorkPackage) parseEntity(ent *message.Entity) error {
+	if mr := ent.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := nw.parseEntity(part); err != nil {
+				return err
+			}
+		}
+	}
+
+	t, typeParams, _ := ent.Header.ContentType()
+	disp, dispParams, _ := ent.Header.ContentDisposition()
+	fileName := dispParams["filename"]
+	if fileName == "" {
+		fileName = typeParams["name"]
+	}
+
+	if disp == "attachment" || fileName != "" {
+		data, err := ioutil.ReadAll(ent.Body)
+		if err != nil {
+			return err
+		}
+		if fileName == "" {
+			fileName = "attachment"
+		}
+		if t == "" {
+			t = "application/octet-stream"
+		}
+		nw.Attachments = append(nw.Attachments, &newAttachment{
+			FileName:    fileName,
+			ContentType: t,
+			Data:        data,
+		})
+		return nil
+	}
+
+	// Use first text part as the description.
+	if nw.Description == "" && (t == "" || t == "text/plain") {
+		data, err := ioutil.ReadAll(ent.Body)
+		if err != nil {
+			return err
+		}
+		nw.Description = string(data)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-smtp"
 
 	id "github.com/ProtonMail/go-imap-id"
 	idle "github.com/emersion/go-imap-idle"
@@ -17,8 +18,30 @@ import (
 )
 
 type ImapFacade struct {
-	backend *backend.Backend
-	server  *server.Server
+	backend   *backend.Backend
+	listeners []*imapListener
+	smtp      *smtp.Server
+
+	// Use STARTTLS instead of implicit TLS
+	smtpStarttls bool
+}
+
+var serverID = id.ID{
+	"name": "OpenProject Facade",
+}
+
+// newServer creates an IMAP server with the supported extensions.
+func newServer(be *listenerBackend) *server.Server {
+	s := server.New(be)
+
+	// Add extensions
+	s.Enable(idle.NewExtension())
+	s.Enable(id.NewExtension(serverID))
+	s.Enable(move.NewExtension())
+	s.Enable(specialuse.NewExtension())
+	s.Enable(unselect.NewExtension())
+
+	return s
 }
 
 func NewFacade() (*ImapFacade, error) {
@@ -30,53 +53,61 @@ func NewFacade() (*ImapFacade, error) {
 	if cfgIMAP == nil {
 		log.Fatal("Missing 'imap'")
 	}
+	listeners, err := ListenerConfigs(cfgIMAP)
+	if err != nil {
+		return nil, err
+	}
+
 	// Create a OpenProject backend
 	be := backend.New(cfgOP)
 
-	addr := cfgIMAP.GetString("address")
-
-	serverID := id.ID{
-		"name": "OpenProject Facade",
+	facade := &ImapFacade{
+		backend: be,
 	}
 
-	// Create a new server
-	s := server.New(be)
-
-	// Add extensions
-	s.Enable(idle.NewExtension())
-	s.Enable(id.NewExtension(serverID))
-	s.Enable(move.NewExtension())
-	s.Enable(specialuse.NewExtension())
-	s.Enable(unselect.NewExtension())
+	// Create a server for each listener
+	for _, cfg := range listeners {
+		l, err := newImapListener(be, cfg)
+		if err != nil {
+			be.Close()
+			return nil, err
+		}
+		facade.listeners = append(facade.listeners, l)
+	}
 
-	s.Addr = addr
-	if tlsEnabled {
-		s.TLSConfig = tlsConfig
+	// Optional SMTP server for replies to work package messages.
+	if cfgSMTP := viper.Sub("smtp"); cfgSMTP != nil && cfgSMTP.GetBool("enabled") {
+		facade.smtp = NewSubmissionServer(be, cfgSMTP)
+		facade.smtpStarttls = cfgSMTP.GetBool("starttls")
 	}
-	// Since we will use this server for testing only, we can allow plain text
-	// authentication over unencrypted connections
-	s.AllowInsecureAuth = true
 
-	return &ImapFacade{
-		backend: be,
-		server:  s,
-	}, nil
+	return facade, nil
 }
 
 func (g *ImapFacade) Close() {
-	g.server.Close()
+	for _, l := range g.listeners {
+		l.server.Close()
+	}
+	if g.smtp != nil {
+		g.smtp.Close()
+	}
 	g.backend.Close()
 }
 
 func (g *ImapFacade) Run() {
-	log.Println("Starting IMAP server at:", g.server.Addr)
-	var err error
-	if tlsEnabled {
-		err = g.server.ListenAndServeTLS()
-	} else {
-		err = g.server.ListenAndServe()
+	if g.smtp != nil {
+		go runSubmissionServer(g.smtp, g.smtpStarttls)
 	}
-	if err != nil {
+
+	go fanOutUpdates(g.backend, g.listeners)
+
+	errs := make(chan error, len(g.listeners))
+	for _, l := range g.listeners {
+		go func(l *imapListener) {
+			errs <- l.serve()
+		}(l)
+	}
+	if err := <-errs; err != nil {
 		log.Fatal(err)
 	}
 }
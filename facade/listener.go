@@ -0,0 +1,170 @@
+package facade
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+
+	"github.com/emersion/go-imap/server"
+
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+// TLS modes of listeners.
+const (
+	TLSImplicit = "implicit"
+	TLSStartTLS = "starttls"
+	TLSNone     = "none"
+)
+
+// ListenerConfig is an IMAP listener from `[[imap.listeners]]`.
+type ListenerConfig struct {
+	// Network: tcp or unix
+	Network string
+	// Listen address or unix socket path
+	Address string
+	// TLS mode: implicit, starttls or none.  Defaults to implicit when TLS is
+	// enabled (none for unix sockets).
+	TLS string
+	// Allow plain text logins without TLS.  Always allowed when the TLS mode
+	// is none.
+	AllowInsecureAuth bool
+	// Accept PROXY protocol (v1/v2) headers from `TrustedProxies`.
+	ProxyProtocol bool
+	// Addresses or CIDR ranges of the proxies/load balancers.
+	TrustedProxies []string
+}
+
+// ListenerConfigs returns the configured IMAP listeners.  Without
+// `[[imap.listeners]]` a single listener is created from `address` and
+// `starttls`.
+func ListenerConfigs(cfg *viper.Viper) ([]ListenerConfig, error) {
+	var listeners []ListenerConfig
+	if err := cfg.UnmarshalKey("listeners", &listeners); err != nil {
+		return nil, fmt.Errorf("Invalid `imap.listeners`: %v", err)
+	}
+	if len(listeners) == 0 {
+		l := ListenerConfig{
+			Address: cfg.GetString("address"),
+		}
+		if cfg.GetBool("starttls") {
+			l.TLS = TLSStartTLS
+		}
+		listeners = append(listeners, l)
+	}
+
+	for i := range listeners {
+		l := &listeners[i]
+		if l.Network == "" {
+			l.Network = "tcp"
+		}
+		if l.Network != "tcp" && l.Network != "unix" {
+			return nil, fmt.Errorf("Unknown listener network: %s", l.Network)
+		}
+		switch l.TLS {
+		case "", TLSImplicit, TLSStartTLS, TLSNone:
+		default:
+			return nil, fmt.Errorf("Unknown listener TLS mode: %s", l.TLS)
+		}
+		if l.ProxyProtocol && l.Network != "tcp" {
+			return nil, fmt.Errorf("Listener %s: `proxyProtocol` requires a tcp listener", l.Address)
+		}
+		if l.ProxyProtocol && len(l.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("Listener %s: `trustedProxies` required for `proxyProtocol`", l.Address)
+		}
+	}
+	return listeners, nil
+}
+
+// TLSMode returns the listener's TLS mode.
+func (c *ListenerConfig) TLSMode(tlsEnabled bool) string {
+	if !tlsEnabled {
+		return TLSNone
+	}
+	if c.TLS == "" {
+		if c.Network == "unix" {
+			return TLSNone
+		}
+		return TLSImplicit
+	}
+	return c.TLS
+}
+
+// imapListener is an IMAP server for one of the listeners.  All listeners
+// share the same backend.
+type imapListener struct {
+	cfg     ListenerConfig
+	tls     string
+	server  *server.Server
+	backend *listenerBackend
+}
+
+func newImapListener(be *backend.Backend, cfg ListenerConfig) (*imapListener, error) {
+	mode := cfg.TLSMode(tlsEnabled)
+	if cfg.TLS != "" && cfg.TLS != TLSNone && mode == TLSNone {
+		return nil, fmt.Errorf("Listener %s requires TLS, but TLS is disabled", cfg.Address)
+	}
+
+	lb := newListenerBackend(be)
+	s := newServer(lb)
+	s.Addr = cfg.Address
+	if mode != TLSNone {
+		s.TLSConfig = tlsConfig
+	}
+	// Only allow plain text authentication over unencrypted connections when
+	// TLS isn't available or the listener allows it (e.g. a local unix
+	// socket).
+	s.AllowInsecureAuth = mode == TLSNone || cfg.AllowInsecureAuth
+
+	return &imapListener{
+		cfg:     cfg,
+		tls:     mode,
+		server:  s,
+		backend: lb,
+	}, nil
+}
+
+func (l *imapListener) listen() (net.Listener, error) {
+	if l.cfg.Network == "unix" {
+		// Remove stale socket
+		if err := os.Remove(l.cfg.Address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen(l.cfg.Network, l.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if l.cfg.ProxyProtocol {
+		// The PROXY header comes before the TLS handshake.  Connections from
+		// other addresses can't send a PROXY header.
+		policy, err := proxyproto.StrictWhiteListPolicy(l.cfg.TrustedProxies)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("Invalid `trustedProxies`: %v", err)
+		}
+		ln = &proxyproto.Listener{
+			Listener: ln,
+			Policy:   policy,
+		}
+	}
+	if l.tls == TLSImplicit {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	return ln, nil
+}
+
+func (l *imapListener) serve() error {
+	ln, err := l.listen()
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting IMAP server at: %s (%s, tls: %s, proxy protocol: %v)",
+		l.cfg.Address, l.cfg.Network, l.tls, l.cfg.ProxyProtocol)
+	return l.server.Serve(ln)
+}
@@ -0,0 +1,19 @@
+package facade
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// RunMetricsServer serves the metrics (e.g. login failures) as JSON at
+// `/debug/vars`.
+func RunMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Println("Starting metrics server at:", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,46 @@
+package facade
+
+import (
+	"log"
+
+	"github.com/spf13/viper"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+// NewSubmissionServer creates a SMTP server for submitting replies to work
+// package messages.
+func NewSubmissionServer(be *backend.Backend, cfg *viper.Viper) *smtp.Server {
+	s := smtp.NewServer(be.NewSubmission())
+
+	s.Addr = cfg.GetString("address")
+	s.Domain = cfg.GetString("domain")
+	s.MaxMessageBytes = cfg.GetInt("maxMessageBytes")
+	if s.MaxMessageBytes == 0 {
+		s.MaxMessageBytes = 25 * 1024 * 1024
+	}
+	s.MaxRecipients = 50
+	if tlsEnabled {
+		s.TLSConfig = tlsConfig
+	}
+	// Same as the IMAP server, only allow plain text authentication over
+	// unencrypted connections when TLS isn't available.
+	s.AllowInsecureAuth = !tlsEnabled
+
+	return s
+}
+
+func runSubmissionServer(s *smtp.Server, starttls bool) {
+	log.Println("Starting SMTP server at:", s.Addr)
+	var err error
+	if tlsEnabled && !starttls {
+		err = s.ListenAndServeTLS()
+	} else {
+		err = s.ListenAndServe()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
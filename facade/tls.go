@@ -4,6 +4,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/spf13/viper"
 
@@ -24,9 +28,7 @@ func InitTLS(cfg *viper.Viper) error {
 
 	auto := cfg.GetBool("auto")
 	if !auto {
-		log.Println("-------- TODO: manual cert loading.")
-		tlsEnabled = false
-		return nil
+		return initManualTLS(cfg)
 	}
 
 	// Setup simplecert
@@ -66,3 +68,76 @@ func InitTLS(cfg *viper.Viper) error {
 
 	return nil
 }
+
+// initManualTLS loads the certificate from `certFile` and `keyFile`.  The
+// certificate is reloaded on SIGHUP.
+func initManualTLS(cfg *viper.Viper) error {
+	certFile := cfg.GetString("certFile")
+	keyFile := cfg.GetString("keyFile")
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("`tls.certFile` and `tls.keyFile` required when `tls.auto` is false.")
+	}
+
+	certReloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	go certReloader.reloadOnSignal()
+
+	mode := cfg.GetString("mode")
+	tlsConfig = tlsconfig.NewServerTLSConfig(tlsconfig.TLSModeServer(mode))
+	tlsConfig.GetCertificate = certReloader.GetCertificate
+
+	return nil
+}
+
+// certReloader keeps the certificate loaded from certFile/keyFile.
+type certReloader struct {
+	sync.RWMutex
+
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate: %v", err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// reloadOnSignal reloads the certificate when the process gets a SIGHUP.
+// Keeps the old certificate if the new one fails to load.
+func (r *certReloader) reloadOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		log.Println("Reloading TLS certificate:", r.certFile)
+		if err := r.load(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,60 @@
+package facade
+
+import (
+	imapbackend "github.com/emersion/go-imap/backend"
+
+	"github.com/lectio/imap-facade-openproject/facade/backend"
+)
+
+// listenerBackend gives the server of each listener its own updates channel.
+type listenerBackend struct {
+	*backend.Backend
+
+	updates chan imapbackend.Update
+}
+
+func newListenerBackend(be *backend.Backend) *listenerBackend {
+	return &listenerBackend{
+		Backend: be,
+		updates: make(chan imapbackend.Update),
+	}
+}
+
+func (lb *listenerBackend) Updates() <-chan imapbackend.Update {
+	return lb.updates
+}
+
+// fanOutUpdates sends a copy of each backend update to all listeners.  The
+// update is done when all copies have been sent.
+func fanOutUpdates(be *backend.Backend, listeners []*imapListener) {
+	for update := range be.Updates() {
+		var done []chan struct{}
+		for _, l := range listeners {
+			u := copyUpdate(update)
+			done = append(done, u.Done())
+			l.backend.updates <- u
+		}
+
+		go func(update imapbackend.Update) {
+			for _, wait := range done {
+				<-wait
+			}
+			close(update.Done())
+		}(update)
+	}
+}
+
+func copyUpdate(update imapbackend.Update) imapbackend.Update {
+	u := imapbackend.NewUpdate(update.Username(), update.Mailbox())
+	switch update := update.(type) {
+	case *imapbackend.StatusUpdate:
+		return &imapbackend.StatusUpdate{Update: u, StatusResp: update.StatusResp}
+	case *imapbackend.MailboxUpdate:
+		return &imapbackend.MailboxUpdate{Update: u, MailboxStatus: update.MailboxStatus}
+	case *imapbackend.MessageUpdate:
+		return &imapbackend.MessageUpdate{Update: u, Message: update.Message}
+	case *imapbackend.ExpungeUpdate:
+		return &imapbackend.ExpungeUpdate{Update: u, SeqNum: update.SeqNum}
+	}
+	return u
+}
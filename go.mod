@@ -18,6 +18,7 @@ require (
 	github.com/emersion/go-imap-specialuse v0.0.0-20161227184202-ba031ced6a62
 	github.com/emersion/go-imap-unselect v0.0.0-20171113212723-b985794e5f26
 	github.com/emersion/go-message v0.10.7
+	github.com/emersion/go-smtp v0.15.0
 	github.com/foomo/simplecert v0.0.0-00010101000000-7b4b298b2c63
 	github.com/foomo/tlsconfig v0.0.0-20180418120404-b67861b076c9
 	github.com/golang/snappy v0.0.1 // indirect
@@ -26,7 +27,9 @@ require (
 	github.com/jordan-wright/email v0.0.0-20190819015918-041e0cec78b0
 	github.com/lectio/go-json-hal v0.0.0-00010101000000-82b7b43647a9
 	github.com/mitchellh/copystructure v1.0.0 // indirect
+	github.com/pires/go-proxyproto v0.6.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.4.0
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
+	go.etcd.io/bbolt v1.3.2
 )